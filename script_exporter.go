@@ -1,102 +1,1460 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 )
 
 var (
 	showVersion   = flag.Bool("version", false, "Print version information.")
+	dryRunFlag    = flag.Bool("dry-run", false, "Run every script once, print the results and exit.")
 	configFile    = flag.String("config.file", "script-exporter.yml", "Script exporter configuration file.")
+	configDir     = flag.String("config.dir", "", "Directory of *.yml configuration files to merge. Overrides -config.file.")
 	listenAddress = flag.String("web.listen-address", ":9172", "The address to listen on for HTTP requests.")
 	metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	labelsFlag    = flag.String("labels.external", "", "Labels added to every probe series, as name=value pairs separated by commas. Values may reference ${VAR}.")
+	metricsPrefix = flag.String("metrics.prefix", "", "Prefix added to the names of metrics parsed from script output.")
 	shell         = flag.String("config.shell", "/bin/sh", "Shell to execute script")
+	logFormat     = flag.String("log.format", "logfmt", "Output format of log messages, logfmt or json.")
+	requireScript = flag.Bool("config.require-scripts", false, "Reject configurations that define no scripts.")
+	expandEnv     = flag.Bool("config.expand-env", false, "Expand ${VAR} references to environment variables in the config file. Use $$ for a literal $.")
+	authUser      = flag.String("web.auth-user", "", "Username required to access the metrics and probe endpoints.")
+	authPassword  = flag.String("web.auth-password", "", "Password required to access the metrics and probe endpoints.")
+	maxTimeout    = flag.Duration("script.max-timeout", 0, "Maximum time any script may run, capping script timeouts, and the default timeout if the config doesn't set one. 0 for no limit.")
+	maxOutput     = flag.Int64("script.max-output-bytes", 0, "Maximum number of bytes of stdout and of stderr kept from each script run, 0 for no limit.")
+	maxConcurrent = flag.Int("max-concurrent-scripts", 0, "Maximum number of scripts to run at once, 0 for no limit.")
+	noCollectors  = flag.Bool("web.disable-default-collectors", false, "Leave the Go runtime and process metrics out of /metrics.")
+	enableGzip    = flag.Bool("web.enable-gzip", true, "Compress /metrics responses for clients that accept gzip.")
+	enableOM      = flag.Bool("web.enable-openmetrics", false, "Serve /metrics in the OpenMetrics format to clients that request it.")
+	enableOutput  = flag.Bool("web.enable-output-endpoint", false, "Serve the stdout of each script's last run at /output.")
+	enableConfig  = flag.Bool("web.enable-config-endpoint", false, "Serve the running configuration, which includes script contents, at /config.")
+	webConfigFile = flag.String("web.config.file", "", "Path to a web configuration file enabling TLS. Minimal example:\n"+
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key")
+
+	scriptFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "script_failure_total",
+			Help: "Total number of failed script executions.",
+		},
+		[]string{"script"},
+	)
+
+	lastRunSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "script_last_run_timestamp_seconds",
+			Help: "Timestamp of the end of the script's last run, successful or not.",
+		},
+		[]string{"script"},
+	)
+
+	scriptStderrBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "script_stderr_bytes_total",
+			Help: "Total number of bytes scripts wrote to stderr.",
+		},
+		[]string{"script"},
+	)
+
+	scriptParseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "script_parse_errors_total",
+			Help: "Total number of script runs whose output could not be parsed.",
+		},
+		[]string{"script"},
+	)
+
+	configuredScripts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "script_exporter_scripts_total",
+			Help: "Number of scripts in the running configuration.",
+		},
+	)
+
+	configReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "script_exporter_config_last_reload_success",
+			Help: "Whether the last configuration reload attempt succeeded.",
+		},
+	)
+
+	configReloadSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "script_exporter_config_last_reload_timestamp_seconds",
+			Help: "Timestamp of the last configuration reload attempt.",
+		},
+	)
+
+	metricsResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "script_exporter_metrics_response_size_bytes",
+			Help:    "Size of /metrics responses as sent, after any compression.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		},
+		[]string{},
+	)
+
+	scriptTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "script_timeouts_total",
+			Help: "Total number of script runs killed for exceeding their timeout.",
+		},
+		[]string{"script"},
+	)
+
+	lastParseSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "script_last_successful_parse_timestamp_seconds",
+			Help: "Timestamp of the last run whose output was parsed into at least one metric.",
+		},
+		[]string{"script"},
+	)
+
+	scriptOutputLines = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "script_output_lines",
+			Help: "Number of lines the script's last run printed to stdout.",
+		},
+		[]string{"script"},
+	)
+
+	skippedRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "script_skipped_runs_total",
+			Help: "Total number of runs skipped because the script's previous run was still in progress.",
+		},
+		[]string{"script"},
+	)
+
+	delayedRuns = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "script_exporter_delayed_runs_total",
+			Help: "Total number of script executions delayed by -max-concurrent-scripts.",
+		},
+	)
+
+	errScriptTimeout = errors.New("script timed out")
+
+	// outputDrainTimeout is how long to keep reading a script's output after
+	// it has exited, for processes it left behind that still hold the pipe.
+	outputDrainTimeout = 100 * time.Millisecond
+
+	// scriptSlots limits the number of scripts running at once. A nil channel
+	// means no limit.
+	scriptSlots chan struct{}
+
+	// externalLabels are added to every series reported by /probe.
+	externalLabels map[string]string
+
+	// lastRuns holds the most recent run of each configured script, by name,
+	// for the /scripts and /output endpoints.
+	lastRuns   = make(map[string]*ScriptRun)
+	lastRunsMu sync.Mutex
+
+	// runningScripts holds the names of scripts with skip_overlapping set
+	// that are currently running.
+	runningScripts   = make(map[string]bool)
+	runningScriptsMu sync.Mutex
 )
 
-type Config struct {
-	Scripts []*Script `yaml:"scripts"`
+type Config struct {
+	DefaultTimeout Duration  `yaml:"default_timeout,omitempty"`
+	TelemetryPath  string    `yaml:"telemetry_path,omitempty"`
+	Scripts        []*Script `yaml:"scripts"`
+}
+
+// SafeConfig holds the running configuration so that it can be swapped out
+// when the configuration file is reloaded.
+type SafeConfig struct {
+	sync.RWMutex
+	C *Config
+
+	// reloadErr is the error from the most recent reload, if it failed.
+	reloadErr error
+}
+
+type Script struct {
+	Name       string            `yaml:"name"`
+	Content    string            `yaml:"script,omitempty"`
+	ScriptFile string            `yaml:"script_file,omitempty"`
+	Timeout    Duration          `yaml:"timeout,omitempty"`
+	KillGrace  Duration          `yaml:"kill_grace,omitempty"`
+	Shell      string            `yaml:"shell,omitempty"`
+	Dir        string            `yaml:"dir,omitempty"`
+	Env        map[string]string `yaml:"env,omitempty"`
+	Command    string            `yaml:"command,omitempty"`
+	Args       []string          `yaml:"args,omitempty"`
+	Stdin      string            `yaml:"stdin,omitempty"`
+	When       string            `yaml:"when,omitempty"`
+	RunAs      string            `yaml:"run_as,omitempty"`
+	Format     string            `yaml:"format,omitempty"`
+	Retries    int               `yaml:"retries,omitempty"`
+	RetryDelay Duration          `yaml:"retry_delay,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+
+	SkipOverlapping bool  `yaml:"skip_overlapping,omitempty"`
+	MaxOutputBytes  int64 `yaml:"max_output_bytes,omitempty"`
+}
+
+// seriesLabels returns the labels added to every series reported for the
+// script. The script's own labels take precedence over external labels.
+func (s *Script) seriesLabels() map[string]string {
+	labels := map[string]string{}
+
+	for name, value := range externalLabels {
+		labels[name] = value
+	}
+
+	for name, value := range s.Labels {
+		labels[name] = value
+	}
+
+	labels["script"] = s.Name
+
+	return labels
+}
+
+// parseExternalLabels parses a comma-separated list of name=value pairs,
+// expanding ${VAR} references in values.
+func parseExternalLabels(spec string) (map[string]string, error) {
+	labels := map[string]string{}
+
+	if spec == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected name=value, received %q", pair)
+		}
+
+		name := strings.TrimSpace(parts[0])
+
+		if name == "script" || !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+
+		labels[name] = os.ExpandEnv(parts[1])
+	}
+
+	return labels, nil
+}
+
+// Duration is a time.Duration read from a Go duration string such as "1m30s".
+// A bare number is read as seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seconds int64
+
+	if err := unmarshal(&seconds); err == nil {
+		*d = Duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+
+	var s string
+
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// WebConfig is the subset of the Prometheus exporter-toolkit web
+// configuration file supported by the exporter.
+type WebConfig struct {
+	TLSConfig TLSServerConfig `yaml:"tls_server_config"`
+}
+
+type TLSServerConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file,omitempty"`
+}
+
+// ScriptRun describes a single run of a script.
+type ScriptRun struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	Success  bool      `json:"success"`
+	ExitCode int       `json:"exit_code"`
+	// Output is the run's stdout, kept only when /output is enabled.
+	Output []byte `json:"-"`
+}
+
+// ScriptState is a configured script and its most recent run, if any, as
+// served by /scripts.
+type ScriptState struct {
+	Name    string     `json:"name"`
+	Timeout float64    `json:"timeout_seconds"`
+	LastRun *ScriptRun `json:"last_run"`
+}
+
+type Measurement struct {
+	Script   *Script
+	Success  int
+	ExitCode int
+	Duration float64
+	Metrics  map[string]*dto.MetricFamily
+	ParseErr error
+}
+
+func loadConfig(configFile string) (*Config, error) {
+	config, err := parseConfigFile(configFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// loadConfigDir loads every *.yml file in configDir, in lexical order, and
+// merges their scripts. Each file's default_timeout only applies to the
+// scripts defined in that file.
+func loadConfigDir(configDir string) (*Config, error) {
+	configFiles, err := filepath.Glob(filepath.Join(configDir, "*.yml"))
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing config directory: %s", err)
+	}
+
+	if len(configFiles) == 0 {
+		return nil, fmt.Errorf("no *.yml files found in config directory %q", configDir)
+	}
+
+	config := &Config{}
+	definedIn := map[string]string{}
+
+	for _, configFile := range configFiles {
+		fileConfig, err := parseConfigFile(configFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", configFile, err)
+		}
+
+		if fileConfig.TelemetryPath != "" {
+			if config.TelemetryPath != "" && config.TelemetryPath != fileConfig.TelemetryPath {
+				return nil, fmt.Errorf("%s: `telemetry_path` %q conflicts with %q", configFile, fileConfig.TelemetryPath, config.TelemetryPath)
+			}
+
+			config.TelemetryPath = fileConfig.TelemetryPath
+		}
+
+		for _, script := range fileConfig.Scripts {
+			if previous, ok := definedIn[script.Name]; ok && previous != configFile && script.Name != "" {
+				return nil, fmt.Errorf("script %q is defined in both %s and %s", script.Name, previous, configFile)
+			}
+
+			definedIn[script.Name] = configFile
+			config.Scripts = append(config.Scripts, script)
+		}
+	}
+
+	if err = validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// parseConfigFile reads a single configuration file, resolving paths
+// relative to it and applying its default timeout, without validating it.
+func parseConfigFile(configFile string) (*Config, error) {
+	yamlFile, err := ioutil.ReadFile(configFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %s", err)
+	}
+
+	if *expandEnv {
+		yamlFile = []byte(os.Expand(string(yamlFile), func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+
+			return os.Getenv(name)
+		}))
+	}
+
+	config := &Config{}
+
+	if err = yaml.Unmarshal(yamlFile, config); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %s", err)
+	}
+
+	for _, script := range config.Scripts {
+		if script.Dir != "" && !filepath.IsAbs(script.Dir) {
+			script.Dir = filepath.Join(filepath.Dir(configFile), script.Dir)
+		}
+
+		if script.ScriptFile == "" {
+			continue
+		}
+
+		if script.Content != "" {
+			return nil, fmt.Errorf("script %q: `script` and `script_file` are mutually exclusive", script.Name)
+		}
+
+		if !filepath.IsAbs(script.ScriptFile) {
+			script.ScriptFile = filepath.Join(filepath.Dir(configFile), script.ScriptFile)
+		}
+
+		content, err := ioutil.ReadFile(script.ScriptFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("script %q: error reading script file: %s", script.Name, err)
+		}
+
+		script.Content = string(content)
+	}
+
+	if config.DefaultTimeout == 0 {
+		config.DefaultTimeout = Duration(15 * time.Second)
+
+		if *maxTimeout > 0 {
+			config.DefaultTimeout = Duration(*maxTimeout)
+		}
+	}
+
+	for _, script := range config.Scripts {
+		if script.Timeout == 0 {
+			script.Timeout = config.DefaultTimeout
+		}
+	}
+
+	return config, nil
+}
+
+// validateConfig checks a loaded configuration and reports every problem
+// found in a single error.
+func validateConfig(config *Config) error {
+	var problems []string
+
+	if config.DefaultTimeout < 0 {
+		problems = append(problems, "`default_timeout` must be positive")
+	}
+
+	if config.TelemetryPath != "" && !strings.HasPrefix(config.TelemetryPath, "/") {
+		problems = append(problems, "`telemetry_path` must start with /")
+	} else if reservedPaths[config.TelemetryPath] {
+		problems = append(problems, fmt.Sprintf("`telemetry_path` %s is used by another endpoint", config.TelemetryPath))
+	}
+
+	if *requireScript && len(config.Scripts) == 0 {
+		problems = append(problems, "no scripts configured")
+	}
+
+	names := make(map[string]bool)
+
+	for i, script := range config.Scripts {
+		if script.Name == "" {
+			problems = append(problems, fmt.Sprintf("script %d: `name` required", i))
+		} else if names[script.Name] {
+			problems = append(problems, fmt.Sprintf("script %q: duplicate name", script.Name))
+		}
+
+		names[script.Name] = true
+
+		if script.Content == "" && script.Command == "" {
+			problems = append(problems, fmt.Sprintf("script %q: `script` or `command` required", script.Name))
+		} else if script.Content != "" && script.Command != "" {
+			problems = append(problems, fmt.Sprintf("script %q: `script` and `command` are mutually exclusive", script.Name))
+		}
+
+		if script.Stdin != "" && script.Command == "" {
+			problems = append(problems, fmt.Sprintf("script %q: `stdin` requires `command`", script.Name))
+		}
+
+		for labelName := range script.Labels {
+			if labelName == "script" || !model.LabelName(labelName).IsValid() {
+				problems = append(problems, fmt.Sprintf("script %q: invalid label name %q", script.Name, labelName))
+			}
+		}
+
+		switch script.Format {
+		case "", "prometheus", "json", "keyvalue":
+		default:
+			problems = append(problems, fmt.Sprintf("script %q: unknown format %q", script.Name, script.Format))
+		}
+
+		if script.Timeout < 0 {
+			problems = append(problems, fmt.Sprintf("script %q: `timeout` must be positive", script.Name))
+		}
+
+		if script.Dir != "" {
+			if info, err := os.Stat(script.Dir); err != nil {
+				problems = append(problems, fmt.Sprintf("script %q: `dir`: %s", script.Name, err))
+			} else if !info.IsDir() {
+				problems = append(problems, fmt.Sprintf("script %q: `dir`: %s is not a directory", script.Name, script.Dir))
+			}
+		}
+
+		if script.RunAs != "" {
+			if _, err := lookupCredential(script.RunAs); err != nil {
+				problems = append(problems, fmt.Sprintf("script %q: `run_as`: %s", script.Name, err))
+			}
+		}
+
+		if script.KillGrace < 0 {
+			problems = append(problems, fmt.Sprintf("script %q: `kill_grace` must not be negative", script.Name))
+		}
+
+		if script.MaxOutputBytes < 0 {
+			problems = append(problems, fmt.Sprintf("script %q: `max_output_bytes` must not be negative", script.Name))
+		}
+
+		if script.Retries < 0 {
+			problems = append(problems, fmt.Sprintf("script %q: `retries` must not be negative", script.Name))
+		}
+
+		if script.RetryDelay < 0 {
+			problems = append(problems, fmt.Sprintf("script %q: `retry_delay` must not be negative", script.Name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// ReloadConfig loads configFile and, if it is valid, replaces the running
+// configuration with it.
+func (sc *SafeConfig) ReloadConfig(configFile string) error {
+	return sc.set(loadConfig(configFile))
+}
+
+// ReloadConfigDir is like ReloadConfig, but merges the configuration files
+// in configDir.
+func (sc *SafeConfig) ReloadConfigDir(configDir string) error {
+	return sc.set(loadConfigDir(configDir))
+}
+
+func (sc *SafeConfig) set(config *Config, err error) error {
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.reloadErr = err
+	configReloadSeconds.SetToCurrentTime()
+
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+
+	configReloadSuccess.Set(1)
+
+	sc.C = config
+	configuredScripts.Set(float64(len(config.Scripts)))
+	pruneLastRuns(config.Scripts)
+
+	return nil
+}
+
+// pruneLastRuns forgets the last run of scripts that are no longer
+// configured.
+func pruneLastRuns(scripts []*Script) {
+	configured := make(map[string]bool, len(scripts))
+
+	for _, script := range scripts {
+		configured[script.Name] = true
+	}
+
+	lastRunsMu.Lock()
+	defer lastRunsMu.Unlock()
+
+	for name := range lastRuns {
+		if !configured[name] {
+			delete(lastRuns, name)
+		}
+	}
+}
+
+// Get returns the running configuration.
+func (sc *SafeConfig) Get() *Config {
+	sc.RLock()
+	defer sc.RUnlock()
+
+	return sc.C
+}
+
+func loadWebConfig(webConfigFile string) (*WebConfig, error) {
+	yamlFile, err := ioutil.ReadFile(webConfigFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading web config file: %s", err)
+	}
+
+	webConfig := &WebConfig{}
+
+	if err = yaml.UnmarshalStrict(yamlFile, webConfig); err != nil {
+		return nil, fmt.Errorf("error parsing web config file: %s", err)
+	}
+
+	if webConfig.TLSConfig.CertFile == "" || webConfig.TLSConfig.KeyFile == "" {
+		return nil, errors.New("web config file: `cert_file` and `key_file` required")
+	}
+
+	// Paths are relative to the web config file, like the exporter-toolkit.
+	dir := filepath.Dir(webConfigFile)
+
+	for _, path := range []*string{&webConfig.TLSConfig.CertFile, &webConfig.TLSConfig.KeyFile, &webConfig.TLSConfig.ClientCAFile} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+
+	return webConfig, nil
+}
+
+// serve accepts connections on listener, using TLS when a web config file is
+// given and plain HTTP otherwise.
+func serve(server *http.Server, listener net.Listener, webConfigFile string) error {
+	if webConfigFile == "" {
+		return server.Serve(listener)
+	}
+
+	webConfig, err := loadWebConfig(webConfigFile)
+
+	if err != nil {
+		return err
+	}
+
+	// With a client CA, only clients presenting a certificate it signed may
+	// connect.
+	if webConfig.TLSConfig.ClientCAFile != "" {
+		caPEM, err := ioutil.ReadFile(webConfig.TLSConfig.ClientCAFile)
+
+		if err != nil {
+			return fmt.Errorf("error reading client CA file: %s", err)
+		}
+
+		clientCAs := x509.NewCertPool()
+
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in client CA file %s", webConfig.TLSConfig.ClientCAFile)
+		}
+
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	return server.ServeTLS(listener, webConfig.TLSConfig.CertFile, webConfig.TLSConfig.KeyFile)
+}
+
+// setLogFormat switches log output to the named format.
+func setLogFormat(format string) error {
+	switch format {
+	case "logfmt":
+		return nil
+	case "json":
+		return log.Base().SetFormat("logger:stderr?json=true")
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+}
+
+// configHandler serves the running configuration as YAML, with the values of
+// script environment variables redacted.
+func configHandler(sc *SafeConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, err := yaml.Marshal(redactConfig(sc.Get()))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(out)
+	})
+}
+
+// redactConfig returns a copy of config with the values of script
+// environment variables hidden.
+func redactConfig(config *Config) *Config {
+	redacted := *config
+	redacted.Scripts = make([]*Script, len(config.Scripts))
+
+	for i, script := range config.Scripts {
+		redactedScript := *script
+
+		// The content was read from the script file, and listing both would
+		// not load again.
+		if script.ScriptFile != "" {
+			redactedScript.Content = ""
+		}
+
+		if len(script.Env) > 0 {
+			redactedScript.Env = make(map[string]string, len(script.Env))
+
+			for key := range script.Env {
+				redactedScript.Env[key] = "<redacted>"
+			}
+		}
+
+		redacted.Scripts[i] = &redactedScript
+	}
+
+	return &redacted
+}
+
+// reservedPaths are the paths of the exporter's other endpoints, which
+// metrics can't be served on.
+var reservedPaths = map[string]bool{
+	"/":        true,
+	"/probe":   true,
+	"/healthz": true,
+	"/scripts": true,
+	"/config":  true,
+	"/output":  true,
+}
+
+// telemetryPath returns the path to serve metrics on: -web.telemetry-path if
+// it was given, otherwise the config's telemetry_path, otherwise the flag's
+// default.
+func telemetryPath(config *Config) string {
+	flagSet := false
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "web.telemetry-path" {
+			flagSet = true
+		}
+	})
+
+	if !flagSet && config.TelemetryPath != "" {
+		return config.TelemetryPath
+	}
+
+	return *metricsPath
+}
+
+// unregisterDefaultCollectors removes the Go runtime and process collectors
+// that client_golang registers on the default registry.
+func unregisterDefaultCollectors() {
+	prometheus.Unregister(prometheus.NewGoCollector())
+	prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// outputHandler serves the stdout of the last run of the script named by the
+// `name` parameter.
+func outputHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+
+		lastRunsMu.Lock()
+		run := lastRuns[name]
+		lastRunsMu.Unlock()
+
+		if run == nil {
+			http.Error(w, fmt.Sprintf("script %q has not run", name), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(run.Output)
+	})
+}
+
+// metricsHandler serves the exporter's own metrics with the given options,
+// recording the size of each response.
+func metricsHandler(opts promhttp.HandlerOpts) http.Handler {
+	handler := promhttp.HandlerFor(prometheus.DefaultGatherer, opts)
+
+	return promhttp.InstrumentHandlerResponseSize(metricsResponseSize,
+		promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, handler))
+}
+
+// scriptsHandler serves the configured scripts and the outcome of their most
+// recent run as JSON.
+func scriptsHandler(sc *SafeConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scripts := sc.Get().Scripts
+		states := make([]*ScriptState, 0, len(scripts))
+
+		lastRunsMu.Lock()
+		for _, script := range scripts {
+			states = append(states, &ScriptState{
+				Name:    script.Name,
+				Timeout: scriptTimeout(script).Seconds(),
+				LastRun: lastRuns[script.Name],
+			})
+		}
+		lastRunsMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states)
+	})
+}
+
+// healthHandler reports whether a configuration has been loaded and the most
+// recent reload succeeded.
+func healthHandler(sc *SafeConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sc.RLock()
+		config, reloadErr := sc.C, sc.reloadErr
+		sc.RUnlock()
+
+		switch {
+		case config == nil:
+			http.Error(w, "config not loaded", http.StatusServiceUnavailable)
+		case reloadErr != nil:
+			http.Error(w, fmt.Sprintf("config reload failed: %s", reloadErr), http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("OK"))
+		}
+	})
+}
+
+// basicAuthHandler requires requests to handler to carry the given basic
+// auth credentials. Authentication is disabled when user is empty.
+func basicAuthHandler(user, password string, handler http.Handler) http.Handler {
+	if user == "" {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqUser, reqPassword, ok := r.BasicAuth()
+
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(reqUser), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(reqPassword), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="script_exporter"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// runScript runs script, retrying up to script.Retries times while it exits
+// with a non-zero status. Timeouts are not retried.
+func runScript(ctx context.Context, script *Script) ([]byte, error) {
+	output, err := runScriptOnce(ctx, script)
+
+	for attempt := 1; attempt <= script.Retries; attempt++ {
+		var exitErr *exec.ExitError
+
+		if !errors.As(err, &exitErr) {
+			break
+		}
+
+		log.With("script", script.Name).Debugf("RETRY: %s (attempt %d of %d).", err, attempt, script.Retries)
+
+		select {
+		case <-ctx.Done():
+			return output, err
+		case <-time.After(time.Duration(script.RetryDelay)):
+		}
+
+		output, err = runScriptOnce(ctx, script)
+	}
+
+	return output, err
+}
+
+// scriptTimeout returns the script's timeout, capped at -script.max-timeout.
+func scriptTimeout(script *Script) time.Duration {
+	timeout := time.Duration(script.Timeout)
+
+	if *maxTimeout > 0 && (timeout == 0 || timeout > *maxTimeout) {
+		return *maxTimeout
+	}
+
+	return timeout
+}
+
+func runScriptOnce(ctx context.Context, script *Script) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, scriptTimeout(script))
+	defer cancel()
+
+	var bashCmd *exec.Cmd
+
+	if script.Command != "" {
+		bashCmd = exec.Command(script.Command, script.Args...)
+	} else {
+		scriptShell := script.Shell
+
+		if scriptShell == "" {
+			scriptShell = *shell
+		}
+
+		bashCmd = exec.Command(scriptShell)
+	}
+
+	bashCmd.Dir = script.Dir
+	setProcessGroup(bashCmd)
+
+	if script.RunAs != "" {
+		if err := setCredential(bashCmd, script.RunAs); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(script.Env) > 0 {
+		bashCmd.Env = os.Environ()
+
+		for key, value := range script.Env {
+			bashCmd.Env = append(bashCmd.Env, key+"="+os.ExpandEnv(value))
+		}
+	}
+
+	if script.Command == "" {
+		bashCmd.Stdin = strings.NewReader(script.Content)
+	} else if script.Stdin != "" {
+		bashCmd.Stdin = strings.NewReader(script.Stdin)
+	}
+
+	limit := script.MaxOutputBytes
+
+	if limit == 0 {
+		limit = *maxOutput
+	}
+
+	stdout, err := newOutputPipe(limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stdout.reader.Close()
+
+	stderr, err := newOutputPipe(limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stderr.reader.Close()
+
+	bashCmd.Stdout = stdout.writer
+	bashCmd.Stderr = stderr.writer
+
+	err = bashCmd.Start()
+	stdout.writer.Close()
+	stderr.writer.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// On timeout, kill everything the script started rather than just the
+	// script itself, after giving it kill_grace to exit on SIGTERM.
+	waitDone := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if script.KillGrace > 0 {
+				terminateProcessGroup(bashCmd)
+
+				select {
+				case <-time.After(time.Duration(script.KillGrace)):
+				case <-waitDone:
+				}
+			}
+
+			killProcessGroup(bashCmd)
+		case <-waitDone:
+		}
+	}()
+
+	err = bashCmd.Wait()
+	close(waitDone)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errScriptTimeout
+		scriptTimeouts.WithLabelValues(script.Name).Inc()
+	}
+
+	logger := log.With("script", script.Name)
+	drainDeadline := time.Now().Add(outputDrainTimeout)
+
+	if errOutput := stderr.Bytes(drainDeadline); len(errOutput) > 0 {
+		logger.Warnf("STDERR: %s", bytes.TrimSpace(errOutput))
+		scriptStderrBytes.WithLabelValues(script.Name).Add(float64(len(errOutput)))
+	}
+
+	output := stdout.Bytes(drainDeadline)
+
+	if stdout.truncated {
+		logger.Warnf("Output truncated to %d bytes", limit)
+	}
+
+	return output, err
 }
 
-type Script struct {
-	Name    string `yaml:"name"`
-	Content string `yaml:"script"`
-	Timeout int64  `yaml:"timeout"`
+// exitCode returns the exit status of a script run, using 124 for timeouts
+// like GNU timeout(1) and -1 when the script could not be started.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errScriptTimeout):
+		return 124
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	default:
+		return -1
+	}
 }
 
-type Measurement struct {
-	Script   *Script
-	Success  int
-	Duration float64
+// outputPipe collects the output of a process through a pipe we own, rather
+// than one created by exec, so that processes left behind by a script can't
+// keep Wait blocked past the timeout.
+type outputPipe struct {
+	reader    *os.File
+	writer    *os.File
+	buffer    bytes.Buffer
+	truncated bool
+	done      chan struct{}
 }
 
-func runScript(script *Script) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(script.Timeout)*time.Second)
-	defer cancel()
+// newOutputPipe creates a pipe that keeps at most limit bytes of output, or
+// everything if limit is 0. Output beyond the limit is read and discarded so
+// that the process writing it doesn't block.
+func newOutputPipe(limit int64) (*outputPipe, error) {
+	reader, writer, err := os.Pipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := &outputPipe{reader: reader, writer: writer, done: make(chan struct{})}
+
+	go func() {
+		defer close(pipe.done)
+
+		if limit <= 0 {
+			pipe.buffer.ReadFrom(reader)
+			return
+		}
+
+		pipe.buffer.ReadFrom(io.LimitReader(reader, limit))
+
+		if discarded, _ := io.Copy(ioutil.Discard, reader); discarded > 0 {
+			pipe.truncated = true
+		}
+	}()
+
+	return pipe, nil
+}
+
+// Bytes waits for all writers to close the pipe, or until deadline, and
+// returns the output read so far. Processes started in the background by a
+// script may hold the pipe open long after the script has exited, so the
+// deadline should be shortly after it did. Truncated output is cut back to
+// its last complete line.
+func (p *outputPipe) Bytes(deadline time.Time) []byte {
+	select {
+	case <-p.done:
+	case <-time.After(time.Until(deadline)):
+		p.reader.Close()
+		<-p.done
+	}
 
-	bashCmd := exec.CommandContext(ctx, *shell)
+	output := p.buffer.Bytes()
 
-	bashIn, err := bashCmd.StdinPipe()
+	if p.truncated {
+		output = output[:bytes.LastIndexByte(output, '\n')+1]
+	}
+
+	return output
+}
+
+// parseOutput parses the metrics printed by a script according to its
+// format. Scripts without a format only report their exit status.
+func parseOutput(script *Script, output []byte) (map[string]*dto.MetricFamily, error) {
+	var families map[string]*dto.MetricFamily
+	var err error
+
+	switch script.Format {
+	case "prometheus":
+		var parser expfmt.TextParser
+		families, err = parser.TextToMetricFamilies(bytes.NewReader(output))
+	case "json":
+		families, err = parseJSONOutput(output)
+	case "keyvalue":
+		families, err = parseKeyValueOutput(output)
+	default:
+		return nil, nil
+	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err = bashCmd.Start(); err != nil {
-		return err
+	// The probe's own series are written before the parsed families, so a
+	// family reusing their names would make the response invalid.
+	for name := range families {
+		if reservedMetricNames[*metricsPrefix+name] {
+			return nil, fmt.Errorf("metric name %s is reserved for the probe results", *metricsPrefix+name)
+		}
 	}
 
-	if _, err = bashIn.Write([]byte(script.Content)); err != nil {
-		return err
+	return families, nil
+}
+
+// reservedMetricNames are the metrics writeMeasurements reports for every
+// script.
+var reservedMetricNames = map[string]bool{
+	"script_duration_seconds": true,
+	"script_success":          true,
+	"script_exit_code":        true,
+}
+
+// JSONSample is a single value printed by a script using the json format.
+type JSONSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// parseJSONOutput reads a sequence of JSON samples, or arrays of samples,
+// and converts them to untyped metric families.
+func parseJSONOutput(output []byte) (map[string]*dto.MetricFamily, error) {
+	families := make(map[string]*dto.MetricFamily)
+	decoder := json.NewDecoder(bytes.NewReader(output))
+
+	for {
+		var raw json.RawMessage
+
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var samples []JSONSample
+
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+			if err := json.Unmarshal(raw, &samples); err != nil {
+				return nil, err
+			}
+		} else {
+			var sample JSONSample
+
+			if err := json.Unmarshal(raw, &sample); err != nil {
+				return nil, err
+			}
+
+			samples = append(samples, sample)
+		}
+
+		for _, sample := range samples {
+			if err := addUntypedSample(families, sample.Name, sample.Labels, sample.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return families, nil
+}
+
+// parseKeyValueOutput reads lines of the form `name value key=value ...`,
+// skipping blank lines and lines starting with #, and converts them to
+// untyped metric families.
+func parseKeyValueOutput(output []byte) (map[string]*dto.MetricFamily, error) {
+	families := make(map[string]*dto.MetricFamily)
+
+	for i, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a metric name and value", i+1)
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value %q", i+1, fields[1])
+		}
+
+		labels := make(map[string]string, len(fields)-2)
+
+		for _, field := range fields[2:] {
+			pair := strings.SplitN(field, "=", 2)
+
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("line %d: expected key=value, received %q", i+1, field)
+			}
+
+			labels[pair[0]] = pair[1]
+		}
+
+		if err := addUntypedSample(families, fields[0], labels, value); err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+	}
+
+	return families, nil
+}
+
+// addUntypedSample adds a sample to the untyped family of the given name,
+// creating it if needed.
+func addUntypedSample(families map[string]*dto.MetricFamily, name string, labels map[string]string, value float64) error {
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+
+	metric := &dto.Metric{Untyped: &dto.Untyped{Value: proto.Float64(value)}}
+
+	for labelName, labelValue := range labels {
+		if !model.LabelName(labelName).IsValid() {
+			return fmt.Errorf("invalid label name %q", labelName)
+		}
+
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(labelName), Value: proto.String(labelValue)})
+	}
+
+	sort.Slice(metric.Label, func(i, j int) bool {
+		return metric.Label[i].GetName() < metric.Label[j].GetName()
+	})
+
+	family, ok := families[name]
+
+	if !ok {
+		family = &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_UNTYPED.Enum()}
+		families[name] = family
 	}
 
-	bashIn.Close()
+	family.Metric = append(family.Metric, metric)
 
-	return bashCmd.Wait()
+	return nil
 }
 
-func runScripts(scripts []*Script) []*Measurement {
+// acquireScriptSlot blocks until a script may run and returns a function
+// releasing the slot.
+func acquireScriptSlot() func() {
+	slots := scriptSlots
+
+	if slots == nil {
+		return func() {}
+	}
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		delayedRuns.Inc()
+		slots <- struct{}{}
+	}
+
+	return func() { <-slots }
+}
+
+// startRun marks the script as running, returning false if it already is.
+// The returned function marks the run as finished.
+func startRun(name string) (func(), bool) {
+	runningScriptsMu.Lock()
+	defer runningScriptsMu.Unlock()
+
+	if runningScripts[name] {
+		return nil, false
+	}
+
+	runningScripts[name] = true
+
+	return func() {
+		runningScriptsMu.Lock()
+		delete(runningScripts, name)
+		runningScriptsMu.Unlock()
+	}, true
+}
+
+// countLines counts the lines in output, including a final line without a
+// trailing newline.
+func countLines(output []byte) int {
+	lines := bytes.Count(output, []byte("\n"))
+
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		lines++
+	}
+
+	return lines
+}
+
+// shouldRun runs the script's `when` condition, if it has one, through its
+// shell and reports whether the condition exited successfully. The condition
+// runs under the script's name, so its timeouts and stderr are counted as the
+// script's.
+func shouldRun(ctx context.Context, script *Script) (bool, error) {
+	if script.When == "" {
+		return true, nil
+	}
+
+	condition := *script
+	condition.Content = script.When
+	condition.Command = ""
+	condition.Args = nil
+	condition.Stdin = ""
+
+	_, err := runScriptOnce(ctx, &condition)
+
+	var exitErr *exec.ExitError
+
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func runScripts(ctx context.Context, scripts []*Script) []*Measurement {
 	measurements := make([]*Measurement, 0)
 
 	ch := make(chan *Measurement)
 
 	for _, script := range scripts {
 		go func(script *Script) {
+			logger := log.With("script", script.Name)
+
+			if script.SkipOverlapping {
+				finish, ok := startRun(script.Name)
+
+				if !ok {
+					logger.Infof("ERROR: previous run still in progress, skipping.")
+					skippedRuns.WithLabelValues(script.Name).Inc()
+
+					ch <- &Measurement{Script: script, ExitCode: -1}
+					return
+				}
+
+				defer finish()
+			}
+
+			release := acquireScriptSlot()
+			defer release()
+
 			start := time.Now()
 			success := 0
-			err := runScript(script)
+			run, err := shouldRun(ctx, script)
+
+			if err == nil && !run {
+				logger.Debugf("Skipped, `when` condition not met.")
+				ch <- nil
+				return
+			}
+
+			var output []byte
+
+			if err == nil {
+				output, err = runScript(ctx, script)
+			}
+
 			duration := time.Since(start).Seconds()
+			scriptOutputLines.WithLabelValues(script.Name).Set(float64(countLines(output)))
+
+			var metrics map[string]*dto.MetricFamily
+			var parseErr error
 
 			if err == nil {
-				log.Debugf("OK: %s (after %fs).", script.Name, duration)
+				logger.Debugf("OK (after %fs).", duration)
 				success = 1
+
+				if metrics, parseErr = parseOutput(script, output); parseErr != nil {
+					logger.Infof("ERROR: error parsing output: %s", parseErr)
+					scriptParseErrors.WithLabelValues(script.Name).Inc()
+				} else if len(metrics) > 0 {
+					lastParseSeconds.WithLabelValues(script.Name).SetToCurrentTime()
+				}
 			} else {
-				log.Infof("ERROR: %s: %s (failed after %fs).", script.Name, err, duration)
+				logger.Infof("ERROR: %s (failed after %fs).", err, duration)
+				scriptFailures.WithLabelValues(script.Name).Inc()
+			}
+
+			lastRun := &ScriptRun{
+				Time:     start,
+				Duration: duration,
+				Success:  success == 1,
+				ExitCode: exitCode(err),
+			}
+
+			if *enableOutput {
+				lastRun.Output = output
 			}
 
+			lastRunsMu.Lock()
+			lastRuns[script.Name] = lastRun
+			lastRunsMu.Unlock()
+
+			lastRunSeconds.WithLabelValues(script.Name).SetToCurrentTime()
+
 			ch <- &Measurement{
 				Script:   script,
 				Duration: duration,
 				Success:  success,
+				ExitCode: exitCode(err),
+				Metrics:  metrics,
+				ParseErr: parseErr,
 			}
 		}(script)
 	}
 
 	for i := 0; i < len(scripts); i++ {
-		measurements = append(measurements, <-ch)
+		if measurement := <-ch; measurement != nil {
+			measurements = append(measurements, measurement)
+		}
 	}
 
 	return measurements
@@ -139,16 +1497,169 @@ func scriptRunHandler(w http.ResponseWriter, r *http.Request, config *Config) {
 		return
 	}
 
-	measurements := runScripts(scripts)
+	if len(scripts) == 0 {
+		http.Error(w, "no matching scripts found", http.StatusBadRequest)
+		return
+	}
+
+	writeMeasurements(w, runScripts(r.Context(), scripts))
+}
+
+// writeMeasurements writes the probe results for measurements in the
+// Prometheus text format.
+func writeMeasurements(w io.Writer, measurements []*Measurement) {
+	for _, measurement := range measurements {
+		labels := formatLabels(measurement.Script.seriesLabels())
+
+		fmt.Fprintf(w, "script_duration_seconds{%s} %f\n", labels, measurement.Duration)
+		fmt.Fprintf(w, "script_success{%s} %d\n", labels, measurement.Success)
+		fmt.Fprintf(w, "script_exit_code{%s} %d\n", labels, measurement.ExitCode)
+	}
+
+	for _, family := range mergeMetricFamilies(measurements) {
+		expfmt.MetricFamilyToText(w, family)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// formatLabels formats labels for the text exposition format, sorted by name.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+
+	for name, value := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(value)))
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// dryRun runs every configured script once, writes the results to w, and
+// reports whether every script succeeded and its output could be parsed.
+func dryRun(ctx context.Context, w io.Writer, config *Config) bool {
+	measurements := runScripts(ctx, config.Scripts)
+
+	sort.Slice(measurements, func(i, j int) bool {
+		return measurements[i].Script.Name < measurements[j].Script.Name
+	})
+
+	ok := true
+
+	for _, measurement := range measurements {
+		if measurement.ParseErr != nil {
+			fmt.Fprintf(w, "# %s: error parsing output: %s\n", measurement.Script.Name, measurement.ParseErr)
+			ok = false
+		}
+
+		if measurement.Success != 1 {
+			ok = false
+		}
+	}
+
+	writeMeasurements(w, measurements)
+
+	return ok
+}
+
+// scriptNamePlaceholder is replaced by the script's name in the label values
+// of its output.
+const scriptNamePlaceholder = "$SCRIPT_NAME"
+
+// mergeMetricFamilies combines the metrics parsed from each script's output,
+// adding -metrics.prefix to their names and the script's series labels to
+// every series that doesn't already have them. Families are returned sorted
+// by name.
+func mergeMetricFamilies(measurements []*Measurement) []*dto.MetricFamily {
+	merged := make(map[string]*dto.MetricFamily)
 
 	for _, measurement := range measurements {
-		fmt.Fprintf(w, "script_duration_seconds{script=\"%s\"} %f\n", measurement.Script.Name, measurement.Duration)
-		fmt.Fprintf(w, "script_success{script=\"%s\"} %d\n", measurement.Script.Name, measurement.Success)
+		for name, family := range measurement.Metrics {
+			if *metricsPrefix != "" {
+				name = *metricsPrefix + name
+				family.Name = proto.String(name)
+			}
+
+			for _, metric := range family.Metric {
+				for _, label := range metric.Label {
+					if strings.Contains(label.GetValue(), scriptNamePlaceholder) {
+						label.Value = proto.String(strings.ReplaceAll(label.GetValue(), scriptNamePlaceholder, measurement.Script.Name))
+					}
+				}
+
+				for labelName, labelValue := range measurement.Script.seriesLabels() {
+					if !hasLabel(metric, labelName) {
+						metric.Label = append(metric.Label, &dto.LabelPair{
+							Name:  proto.String(labelName),
+							Value: proto.String(labelValue),
+						})
+					}
+				}
+
+				sort.Slice(metric.Label, func(i, j int) bool {
+					return metric.Label[i].GetName() < metric.Label[j].GetName()
+				})
+			}
+
+			existing, ok := merged[name]
+
+			if !ok {
+				merged[name] = family
+				continue
+			}
+
+			if existing.GetType() != family.GetType() {
+				log.With("script", measurement.Script.Name).Infof("ERROR: metric %s has type %s, previously seen as %s", name, family.GetType(), existing.GetType())
+				continue
+			}
+
+			existing.Metric = append(existing.Metric, family.Metric...)
+		}
 	}
+
+	names := make([]string, 0, len(merged))
+
+	for name := range merged {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	families := make([]*dto.MetricFamily, 0, len(names))
+
+	for _, name := range names {
+		families = append(families, merged[name])
+	}
+
+	return families
+}
+
+func hasLabel(metric *dto.Metric, name string) bool {
+	for _, label := range metric.Label {
+		if label.GetName() == name {
+			return true
+		}
+	}
+
+	return false
 }
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("script_exporter"))
+	prometheus.MustRegister(scriptFailures)
+	prometheus.MustRegister(lastRunSeconds)
+	prometheus.MustRegister(delayedRuns)
+	prometheus.MustRegister(scriptStderrBytes)
+	prometheus.MustRegister(scriptParseErrors)
+	prometheus.MustRegister(configuredScripts)
+	prometheus.MustRegister(metricsResponseSize)
+	prometheus.MustRegister(skippedRuns)
+	prometheus.MustRegister(scriptTimeouts)
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadSeconds)
+	prometheus.MustRegister(scriptOutputLines)
+	prometheus.MustRegister(lastParseSeconds)
 }
 
 func main() {
@@ -159,49 +1670,153 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := setLogFormat(*logFormat); err != nil {
+		log.Fatalf("Error configuring logging: %s", err)
+	}
+
 	log.Infoln("Starting script_exporter", version.Info())
 
-	yamlFile, err := ioutil.ReadFile(*configFile)
+	labels, err := parseExternalLabels(*labelsFlag)
 
 	if err != nil {
-		log.Fatalf("Error reading config file: %s", err)
+		log.Fatalf("Invalid external labels: %s", err)
+	}
+
+	externalLabels = labels
+
+	if *metricsPrefix != "" && !model.IsValidMetricName(model.LabelValue(*metricsPrefix)) {
+		log.Fatalf("Invalid metrics prefix %q", *metricsPrefix)
 	}
 
-	config := Config{}
+	if (*authUser == "") != (*authPassword == "") {
+		log.Fatalf("-web.auth-user and -web.auth-password must be set together")
+	}
 
-	err = yaml.Unmarshal(yamlFile, &config)
+	if *noCollectors {
+		unregisterDefaultCollectors()
+	}
 
-	if err != nil {
-		log.Fatalf("Error parsing config file: %s", err)
+	if *maxConcurrent > 0 {
+		scriptSlots = make(chan struct{}, *maxConcurrent)
 	}
 
-	log.Infof("Loaded %d script configurations", len(config.Scripts))
+	sc := &SafeConfig{}
 
-	for _, script := range config.Scripts {
-		if script.Timeout == 0 {
-			script.Timeout = 15
+	reloadConfig := func() error {
+		if *configDir != "" {
+			return sc.ReloadConfigDir(*configDir)
 		}
+
+		return sc.ReloadConfig(*configFile)
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
+	if err := reloadConfig(); err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
 
-	http.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
-		scriptRunHandler(w, r, &config)
-	})
+	log.Infof("Loaded %d script configurations", len(sc.Get().Scripts))
+
+	if *dryRunFlag {
+		if !dryRun(context.Background(), os.Stdout, sc.Get()) {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := reloadConfig(); err != nil {
+				log.Errorf("Error reloading config: %s", err)
+				continue
+			}
+
+			log.Infof("Reloaded %d script configurations", len(sc.Get().Scripts))
+		}
+	}()
+
+	// The handler can't move once registered, so a telemetry_path changed by
+	// a reload takes effect on restart.
+	metricsRoute := telemetryPath(sc.Get())
+
+	if reservedPaths[metricsRoute] {
+		log.Fatalf("Cannot serve metrics on %s, which is used by another endpoint", metricsRoute)
+	}
+
+	http.Handle(metricsRoute, basicAuthHandler(*authUser, *authPassword, metricsHandler(promhttp.HandlerOpts{
+		DisableCompression: !*enableGzip,
+		EnableOpenMetrics:  *enableOM,
+	})))
+
+	http.Handle("/probe", basicAuthHandler(*authUser, *authPassword, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scriptRunHandler(w, r, sc.Get())
+	})))
+
+	http.Handle("/healthz", healthHandler(sc))
+
+	http.Handle("/scripts", basicAuthHandler(*authUser, *authPassword, scriptsHandler(sc)))
+
+	if *enableOutput {
+		http.Handle("/output", basicAuthHandler(*authUser, *authPassword, outputHandler()))
+	}
+
+	if *enableConfig {
+		http.Handle("/config", basicAuthHandler(*authUser, *authPassword, configHandler(sc)))
+	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>Script Exporter</title></head>
 			<body>
 			<h1>Script Exporter</h1>
-			<p><a href="` + *metricsPath + `">Metrics</a></p>
+			<p><a href="` + metricsRoute + `">Metrics</a></p>
 			</body>
 			</html>`))
 	})
 
 	log.Infoln("Listening on", *listenAddress)
 
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+	listener, err := net.Listen("tcp", *listenAddress)
+
+	if err != nil {
+		log.Fatalf("Error starting HTTP server: %s", err)
+	}
+
+	// Requests, and the scripts they run, are cancelled when the exporter is
+	// asked to stop.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := &http.Server{
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+
+	shutdownDone := make(chan struct{})
+
+	go func() {
+		defer close(shutdownDone)
+
+		<-term
+		log.Infoln("Shutting down")
+		cancel()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("Error shutting down HTTP server: %s", err)
+		}
+	}()
+
+	if err := serve(server, listener, *webConfigFile); err != http.ErrServerClosed {
 		log.Fatalf("Error starting HTTP server: %s", err)
 	}
+
+	<-shutdownDone
 }
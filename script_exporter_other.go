@@ -0,0 +1,35 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errRunAsUnsupported = errors.New("`run_as` is not supported on this platform")
+
+// setProcessGroup is a no-op on platforms without process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessGroup kills cmd's process, as there is no signal asking it
+// to exit on these platforms.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// killProcessGroup kills cmd's process. Processes it started are left
+// running on platforms without process groups.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// lookupCredential always fails on platforms without Unix credentials.
+func lookupCredential(runAs string) (struct{}, error) {
+	return struct{}{}, errRunAsUnsupported
+}
+
+// setCredential always fails on platforms without Unix credentials.
+func setCredential(cmd *exec.Cmd, runAs string) error {
+	return errRunAsUnsupported
+}
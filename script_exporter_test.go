@@ -1,19 +1,51 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+	"gopkg.in/yaml.v2"
 )
 
 var config = &Config{
 	Scripts: []*Script{
-		{"success", "exit 0", 1},
-		{"failure", "exit 1", 1},
-		{"timeout", "sleep 5", 2},
+		{Name: "success", Content: "exit 0", Timeout: Duration(time.Second)},
+		{Name: "failure", Content: "exit 1", Timeout: Duration(time.Second)},
+		{Name: "timeout", Content: "sleep 5", Timeout: Duration(2 * time.Second)},
 	},
 }
 
 func TestRunScripts(t *testing.T) {
-	measurements := runScripts(config.Scripts)
+	measurements := runScripts(context.Background(), config.Scripts)
 
 	expectedResults := map[string]struct {
 		success     int
@@ -37,6 +69,377 @@ func TestRunScripts(t *testing.T) {
 	}
 }
 
+func TestRunScriptShell(t *testing.T) {
+	script := &Script{
+		Name:    "bashism",
+		Content: "[[ 1 == 1 ]]",
+		Timeout: Duration(time.Second),
+		Shell:   "/bin/bash",
+	}
+
+	if _, err := runScript(context.Background(), script); err != nil {
+		t.Errorf("Expected script to succeed under %s: %s", script.Shell, err)
+	}
+}
+
+func TestRunScriptEnv(t *testing.T) {
+	os.Setenv("SCRIPT_EXPORTER_TEST_PARENT", "parent")
+	defer os.Unsetenv("SCRIPT_EXPORTER_TEST_PARENT")
+
+	script := &Script{
+		Name:    "env",
+		Content: `test "$FOO" = "bar" && test "$FORWARDED" = "parent"`,
+		Timeout: Duration(time.Second),
+		Env: map[string]string{
+			"FOO":       "bar",
+			"FORWARDED": "${SCRIPT_EXPORTER_TEST_PARENT}",
+		},
+	}
+
+	if _, err := runScript(context.Background(), script); err != nil {
+		t.Errorf("Expected configured environment to be visible to script: %s", err)
+	}
+}
+
+func TestRunScriptDir(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	output, err := runScript(context.Background(), &Script{Name: "pwd", Content: "pwd -P", Timeout: Duration(time.Second), Dir: dir})
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if strings.TrimSpace(string(output)) != dir {
+		t.Errorf("Expected script to run in %s, ran in %s", dir, output)
+	}
+}
+
+func TestRunScriptCommand(t *testing.T) {
+	t.Run("Command", func(t *testing.T) {
+		script := &Script{
+			Name:    "command",
+			Command: "/bin/sh",
+			Args:    []string{"-c", `test "$0" = "--fast" && test "$1" = "db1"`, "--fast", "db1"},
+			Timeout: Duration(time.Second),
+		}
+
+		if _, err := runScript(context.Background(), script); err != nil {
+			t.Errorf("Expected command to receive its arguments: %s", err)
+		}
+	})
+
+	t.Run("CommandFailure", func(t *testing.T) {
+		script := &Script{
+			Name:    "command",
+			Command: "/bin/sh",
+			Args:    []string{"-c", "exit 3"},
+			Timeout: Duration(time.Second),
+		}
+
+		if _, err := runScript(context.Background(), script); err == nil {
+			t.Errorf("Expected failing command to return an error")
+		}
+	})
+
+	t.Run("Stdin", func(t *testing.T) {
+		script := &Script{
+			Name:    "stdin",
+			Command: "cat",
+			Stdin:   "queue_length 3\n",
+			Timeout: Duration(time.Second),
+			Format:  "prometheus",
+		}
+
+		output, err := runScript(context.Background(), script)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		metrics, err := parseOutput(script, output)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if family := metrics["queue_length"]; family == nil || family.Metric[0].GetUntyped().GetValue() != 3 {
+			t.Errorf("Expected stdin to be echoed as a metric, received %q", output)
+		}
+	})
+
+	t.Run("Script", func(t *testing.T) {
+		script := &Script{
+			Name:    "script",
+			Content: `test -z "$1"`,
+			Timeout: Duration(time.Second),
+		}
+
+		if _, err := runScript(context.Background(), script); err != nil {
+			t.Errorf("Expected script piped to the shell to succeed: %s", err)
+		}
+	})
+}
+
+func TestExitCode(t *testing.T) {
+	expectedExitCodes := map[string]int{
+		"success": 0,
+		"failure": 1,
+		"timeout": 124,
+	}
+
+	for _, measurement := range runScripts(context.Background(), config.Scripts) {
+		if expected := expectedExitCodes[measurement.Script.Name]; measurement.ExitCode != expected {
+			t.Errorf("Expected exit code %d for %s, received %d", expected, measurement.Script.Name, measurement.ExitCode)
+		}
+	}
+}
+
+func TestRunScriptRetries(t *testing.T) {
+	newFlakyScript := func(retries int) *Script {
+		marker := filepath.Join(t.TempDir(), "failed-once")
+
+		return &Script{
+			Name:    "flaky",
+			Content: fmt.Sprintf(`test -e %[1]s && exit 0; touch %[1]s; exit 1`, marker),
+			Timeout: Duration(time.Second),
+			Retries: retries,
+		}
+	}
+
+	t.Run("EventualSuccess", func(t *testing.T) {
+		if _, err := runScript(context.Background(), newFlakyScript(1)); err != nil {
+			t.Errorf("Expected script to succeed after retrying: %s", err)
+		}
+	})
+
+	t.Run("NoRetries", func(t *testing.T) {
+		if _, err := runScript(context.Background(), newFlakyScript(0)); err == nil {
+			t.Errorf("Expected script to fail without retries")
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		script := &Script{Name: "slow", Content: "sleep 5", Timeout: Duration(time.Second), Retries: 3}
+		start := time.Now()
+
+		if _, err := runScript(context.Background(), script); err != errScriptTimeout {
+			t.Errorf("Expected timeout, received %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected timeout not to be retried, ran for %s", elapsed)
+		}
+	})
+}
+
+func TestRunScriptsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	measurements := runScripts(ctx, []*Script{{Name: "slow", Content: "sleep 5", Timeout: Duration(10 * time.Second)}})
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected cancelled script to stop early, ran for %s", elapsed)
+	}
+
+	if len(measurements) != 1 || measurements[0].Success != 0 {
+		t.Errorf("Expected cancelled script to fail")
+	}
+}
+
+func TestScriptFailures(t *testing.T) {
+	before := map[string]float64{}
+	timeoutsBefore := map[string]float64{}
+
+	for _, script := range config.Scripts {
+		before[script.Name] = testutil.ToFloat64(scriptFailures.WithLabelValues(script.Name))
+		timeoutsBefore[script.Name] = testutil.ToFloat64(scriptTimeouts.WithLabelValues(script.Name))
+	}
+
+	runScripts(context.Background(), config.Scripts)
+
+	expectedIncrease := map[string]float64{
+		"success": 0,
+		"failure": 1,
+		"timeout": 1,
+	}
+
+	for name, increase := range expectedIncrease {
+		after := testutil.ToFloat64(scriptFailures.WithLabelValues(name))
+
+		if after-before[name] != increase {
+			t.Errorf("Expected failure count for %s to increase by %f, increased by %f", name, increase, after-before[name])
+		}
+	}
+
+	expectedTimeouts := map[string]float64{
+		"success": 0,
+		"failure": 0,
+		"timeout": 1,
+	}
+
+	for name, increase := range expectedTimeouts {
+		after := testutil.ToFloat64(scriptTimeouts.WithLabelValues(name))
+
+		if after-timeoutsBefore[name] != increase {
+			t.Errorf("Expected timeout count for %s to increase by %f, increased by %f", name, increase, after-timeoutsBefore[name])
+		}
+	}
+}
+
+func TestMaxConcurrentScripts(t *testing.T) {
+	scriptSlots = make(chan struct{}, 2)
+	defer func() { scriptSlots = nil }()
+
+	dir := t.TempDir()
+	scripts := make([]*Script, 4)
+
+	// Each script records how many scripts were running when it started.
+	for i := range scripts {
+		scripts[i] = &Script{
+			Name:    fmt.Sprintf("slow%d", i),
+			Content: fmt.Sprintf(`touch %[1]s/running.%[2]d; ls %[1]s | grep -c running > %[1]s/seen.%[2]d; sleep 0.5; rm %[1]s/running.%[2]d`, dir, i),
+			Timeout: Duration(5 * time.Second),
+		}
+	}
+
+	delayedBefore := testutil.ToFloat64(delayedRuns)
+
+	for _, measurement := range runScripts(context.Background(), scripts) {
+		if measurement.Success != 1 {
+			t.Fatalf("Expected script to succeed: %s", measurement.Script.Name)
+		}
+	}
+
+	for i := range scripts {
+		seen, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("seen.%d", i)))
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if running := strings.TrimSpace(string(seen)); running != "1" && running != "2" {
+			t.Errorf("Expected at most 2 scripts running at once, %s saw %s", scripts[i].Name, running)
+		}
+	}
+
+	if delayed := testutil.ToFloat64(delayedRuns) - delayedBefore; delayed != 2 {
+		t.Errorf("Expected 2 delayed runs, received %f", delayed)
+	}
+}
+
+func TestSkipOverlapping(t *testing.T) {
+	dir := t.TempDir()
+	script := &Script{
+		Name:            "overlap",
+		Content:         fmt.Sprintf(`echo run >> %s/runs; sleep 0.5`, dir),
+		Timeout:         Duration(5 * time.Second),
+		SkipOverlapping: true,
+	}
+
+	skippedBefore := testutil.ToFloat64(skippedRuns.WithLabelValues("overlap"))
+
+	first := make(chan []*Measurement)
+
+	go func() { first <- runScripts(context.Background(), []*Script{script}) }()
+
+	time.Sleep(100 * time.Millisecond)
+
+	second := runScripts(context.Background(), []*Script{script})
+
+	if second[0].Success != 0 || second[0].ExitCode != -1 {
+		t.Errorf("Expected overlapping run to be skipped, received %+v", second[0])
+	}
+
+	if (<-first)[0].Success != 1 {
+		t.Errorf("Expected first run to succeed")
+	}
+
+	runs, err := ioutil.ReadFile(filepath.Join(dir, "runs"))
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if strings.Count(string(runs), "run") != 1 {
+		t.Errorf("Expected a single run, received %q", runs)
+	}
+
+	if skipped := testutil.ToFloat64(skippedRuns.WithLabelValues("overlap")) - skippedBefore; skipped != 1 {
+		t.Errorf("Expected 1 skipped run, received %f", skipped)
+	}
+
+	if third := runScripts(context.Background(), []*Script{script}); third[0].Success != 1 {
+		t.Errorf("Expected script to run again once the previous run finished")
+	}
+}
+
+func TestRunScriptsWhen(t *testing.T) {
+	dir := t.TempDir()
+	scripts := []*Script{
+		{Name: "when_true", Content: "exit 0", When: "true", Timeout: Duration(time.Second)},
+		{Name: "when_false", Content: fmt.Sprintf("touch %s/ran", dir), When: "exit 1", Timeout: Duration(time.Second)},
+		{Name: "when_timeout", Content: "exit 0", When: "sleep 5", Timeout: Duration(100 * time.Millisecond)},
+	}
+
+	timeouts := testutil.ToFloat64(scriptTimeouts.WithLabelValues("when_timeout"))
+	measurements := runScripts(context.Background(), scripts)
+
+	if len(measurements) != 2 {
+		t.Fatalf("Expected the skipped script to be left out, received %d measurements", len(measurements))
+	}
+
+	for _, measurement := range measurements {
+		switch measurement.Script.Name {
+		case "when_true":
+			if measurement.Success != 1 {
+				t.Errorf("Expected script with a true condition to run")
+			}
+		case "when_timeout":
+			if measurement.Success != 0 || measurement.ExitCode != 124 {
+				t.Errorf("Expected a condition that timed out to fail the script, received %+v", measurement)
+			}
+
+			if after := testutil.ToFloat64(scriptTimeouts.WithLabelValues("when_timeout")); after-timeouts != 1 {
+				t.Errorf("Expected the condition's timeout to be counted for the script, increased by %f", after-timeouts)
+			}
+		default:
+			t.Errorf("Unexpected measurement for %s", measurement.Script.Name)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "ran")); err == nil {
+		t.Errorf("Expected script with a false condition not to run")
+	}
+}
+
+func TestLastRunTimestamp(t *testing.T) {
+	script := &Script{Name: "last_run", Content: "exit 1", Timeout: Duration(time.Second)}
+
+	runScripts(context.Background(), []*Script{script})
+	first := testutil.ToFloat64(lastRunSeconds.WithLabelValues(script.Name))
+
+	if first == 0 {
+		t.Fatalf("Expected script_last_run_timestamp_seconds to be set for a failed run")
+	}
+
+	runScripts(context.Background(), []*Script{script})
+
+	if second := testutil.ToFloat64(lastRunSeconds.WithLabelValues(script.Name)); second <= first {
+		t.Errorf("Expected timestamp to advance, received %f then %f", first, second)
+	}
+}
+
 func TestScriptFilter(t *testing.T) {
 	t.Run("RequiredParameters", func(t *testing.T) {
 		_, err := scriptFilter(config.Scripts, "", "")
@@ -88,3 +491,1553 @@ func TestScriptFilter(t *testing.T) {
 		}
 	})
 }
+
+func TestScriptRunHandler(t *testing.T) {
+	t.Run("KnownScript", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/probe?name=success", nil)
+		rec := httptest.NewRecorder()
+
+		scriptRunHandler(rec, req, config)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, received %d", http.StatusOK, rec.Code)
+		}
+
+		if !strings.Contains(rec.Body.String(), `script_success{script="success"} 1`) {
+			t.Errorf("Expected success metric not found: %s", rec.Body.String())
+		}
+
+		if !strings.Contains(rec.Body.String(), `script_exit_code{script="success"} 0`) {
+			t.Errorf("Expected exit code metric not found: %s", rec.Body.String())
+		}
+	})
+
+	t.Run("UnknownScript", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/probe?name=sucess", nil)
+		rec := httptest.NewRecorder()
+
+		scriptRunHandler(rec, req, config)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, received %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestLoadConfigExpandEnv(t *testing.T) {
+	os.Setenv("SCRIPT_EXPORTER_TEST_HOST", "db1")
+	defer os.Unsetenv("SCRIPT_EXPORTER_TEST_HOST")
+
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	content := `
+scripts:
+  - name: ping
+    script: ping -c 1 ${SCRIPT_EXPORTER_TEST_HOST} && test $$? -eq 0
+`
+
+	writeFile(t, configFile, content)
+
+	t.Run("Disabled", func(t *testing.T) {
+		loaded, err := loadConfig(configFile)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if expected := "ping -c 1 ${SCRIPT_EXPORTER_TEST_HOST} && test $$? -eq 0"; loaded.Scripts[0].Content != expected {
+			t.Errorf("Expected %q, received %q", expected, loaded.Scripts[0].Content)
+		}
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		*expandEnv = true
+		defer func() { *expandEnv = false }()
+
+		loaded, err := loadConfig(configFile)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if expected := "ping -c 1 db1 && test $? -eq 0"; loaded.Scripts[0].Content != expected {
+			t.Errorf("Expected %q, received %q", expected, loaded.Scripts[0].Content)
+		}
+	})
+}
+
+func TestLoadConfigDefaultTimeout(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	content := `
+default_timeout: 30s
+scripts:
+  - name: inherited
+    script: exit 0
+  - name: overridden
+    script: exit 0
+    timeout: 5s
+`
+
+	writeFile(t, configFile, content)
+
+	loaded, err := loadConfig(configFile)
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if timeout := time.Duration(loaded.Scripts[0].Timeout); timeout != 30*time.Second {
+		t.Errorf("Expected script without timeout to inherit 30s, received %s", timeout)
+	}
+
+	if timeout := time.Duration(loaded.Scripts[1].Timeout); timeout != 5*time.Second {
+		t.Errorf("Expected script timeout to win over default, received %s", timeout)
+	}
+}
+
+func TestMaxTimeout(t *testing.T) {
+	*maxTimeout = 10 * time.Second
+	defer func() { *maxTimeout = 0 }()
+
+	t.Run("Capped", func(t *testing.T) {
+		if timeout := scriptTimeout(&Script{Timeout: Duration(time.Minute)}); timeout != 10*time.Second {
+			t.Errorf("Expected timeout capped at 10s, received %s", timeout)
+		}
+
+		if timeout := scriptTimeout(&Script{Timeout: Duration(5 * time.Second)}); timeout != 5*time.Second {
+			t.Errorf("Expected shorter timeout to be kept, received %s", timeout)
+		}
+
+		if timeout := scriptTimeout(&Script{}); timeout != 10*time.Second {
+			t.Errorf("Expected zero timeout to use the maximum, received %s", timeout)
+		}
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		configFile := filepath.Join(t.TempDir(), "config.yml")
+
+		writeFile(t, configFile, "scripts:\n  - name: unset\n    script: exit 0\n")
+
+		loaded, err := loadConfig(configFile)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if timeout := time.Duration(loaded.Scripts[0].Timeout); timeout != 10*time.Second {
+			t.Errorf("Expected script without timeout to use the maximum, received %s", timeout)
+		}
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		*maxTimeout = 200 * time.Millisecond
+		start := time.Now()
+
+		if _, err := runScript(context.Background(), &Script{Name: "capped", Content: "sleep 5", Timeout: Duration(time.Minute)}); err != errScriptTimeout {
+			t.Errorf("Expected timeout, received %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected script to be stopped at the maximum timeout, ran for %s", elapsed)
+		}
+	})
+}
+
+func TestLoadConfigScriptFile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+
+	if err := os.Mkdir(filepath.Join(dir, "scripts"), 0755); err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+
+	writeFile(t, filepath.Join(dir, "scripts", "check.sh"), "exit 0\n")
+
+	t.Run("Relative", func(t *testing.T) {
+		writeFile(t, configFile, "scripts:\n  - name: check\n    script_file: scripts/check.sh\n")
+
+		loaded, err := loadConfig(configFile)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if loaded.Scripts[0].Content != "exit 0\n" {
+			t.Errorf("Expected script content to be read from file, received %q", loaded.Scripts[0].Content)
+		}
+	})
+
+	t.Run("MutuallyExclusive", func(t *testing.T) {
+		writeFile(t, configFile, "scripts:\n  - name: check\n    script: exit 1\n    script_file: scripts/check.sh\n")
+
+		if _, err := loadConfig(configFile); err == nil {
+			t.Errorf("Expected failure when both script and script_file are set")
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		writeFile(t, configFile, "scripts:\n  - name: check\n    script_file: scripts/missing.sh\n")
+
+		if _, err := loadConfig(configFile); err == nil {
+			t.Errorf("Expected failure when script_file does not exist")
+		}
+	})
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile(t, filepath.Join(dir, "b.yml"), "default_timeout: 5s\nscripts:\n  - name: two\n    script: exit 0\n")
+	writeFile(t, filepath.Join(dir, "a.yml"), "scripts:\n  - name: one\n    script: exit 0\n")
+	writeFile(t, filepath.Join(dir, "ignored.txt"), "not yaml: [")
+
+	t.Run("Merge", func(t *testing.T) {
+		loaded, err := loadConfigDir(dir)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if len(loaded.Scripts) != 2 || loaded.Scripts[0].Name != "one" || loaded.Scripts[1].Name != "two" {
+			t.Fatalf("Expected scripts one and two in file order, received %v", loaded.Scripts)
+		}
+
+		if loaded.Scripts[0].Timeout != Duration(15*time.Second) || loaded.Scripts[1].Timeout != Duration(5*time.Second) {
+			t.Errorf("Expected each file's default timeout to apply to its own scripts")
+		}
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		writeFile(t, filepath.Join(dir, "c.yml"), "scripts:\n  - name: one\n    script: exit 1\n")
+
+		_, err := loadConfigDir(dir)
+
+		if err == nil || !strings.Contains(err.Error(), "a.yml") || !strings.Contains(err.Error(), "c.yml") {
+			t.Errorf("Expected duplicate script to be reported with both files, received %v", err)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if _, err := loadConfigDir(t.TempDir()); err == nil {
+			t.Errorf("Expected failure for a directory without config files")
+		}
+	})
+}
+
+func TestTelemetryPath(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+
+	writeFile(t, configFile, "telemetry_path: /custom-metrics\nscripts: []\n")
+
+	loaded, err := loadConfig(configFile)
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if path := telemetryPath(&Config{}); path != "/metrics" {
+		t.Errorf("Expected default path /metrics, received %s", path)
+	}
+
+	if path := telemetryPath(loaded); path != "/custom-metrics" {
+		t.Errorf("Expected path from config, received %s", path)
+	}
+
+	flag.Set("web.telemetry-path", "/flag-metrics")
+	defer flag.Set("web.telemetry-path", "/metrics")
+
+	if path := telemetryPath(loaded); path != "/flag-metrics" {
+		t.Errorf("Expected an explicitly set flag to win, received %s", path)
+	}
+
+	if err := validateConfig(&Config{TelemetryPath: "metrics"}); err == nil {
+		t.Errorf("Expected a relative telemetry_path to be rejected")
+	}
+
+	for _, path := range []string{"/", "/probe", "/healthz", "/scripts", "/config", "/output"} {
+		if err := validateConfig(&Config{TelemetryPath: path}); err == nil || !strings.Contains(err.Error(), "used by another endpoint") {
+			t.Errorf("Expected telemetry_path %s to be rejected, received %v", path, err)
+		}
+	}
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	for input, expected := range map[string]time.Duration{
+		"1500ms": 1500 * time.Millisecond,
+		"3m":     3 * time.Minute,
+		"15":     15 * time.Second,
+	} {
+		var script Script
+
+		if err := yaml.Unmarshal([]byte("timeout: "+input), &script); err != nil {
+			t.Errorf("Unexpected error for %s: %s", input, err)
+			continue
+		}
+
+		if time.Duration(script.Timeout) != expected {
+			t.Errorf("Expected %s to be read as %s, received %s", input, expected, time.Duration(script.Timeout))
+		}
+	}
+
+	var script Script
+
+	if err := yaml.Unmarshal([]byte("retry_delay: 2\nkill_grace: 500ms"), &script); err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if script.RetryDelay != Duration(2*time.Second) || script.KillGrace != Duration(500*time.Millisecond) {
+		t.Errorf("Expected retry_delay 2s and kill_grace 500ms, received %s and %s", time.Duration(script.RetryDelay), time.Duration(script.KillGrace))
+	}
+
+	if err := yaml.Unmarshal([]byte("timeout: soon"), &script); err == nil {
+		t.Errorf("Expected failure for invalid duration")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		if err := validateConfig(config); err != nil {
+			t.Errorf("Unexpected: %s", err.Error())
+		}
+	})
+
+	t.Run("RequireScripts", func(t *testing.T) {
+		if err := validateConfig(&Config{}); err != nil {
+			t.Errorf("Expected an empty config to be valid by default, received %s", err)
+		}
+
+		*requireScript = true
+		defer func() { *requireScript = false }()
+
+		if err := validateConfig(&Config{}); err == nil || !strings.Contains(err.Error(), "no scripts configured") {
+			t.Errorf("Expected an empty config to be rejected, received %v", err)
+		}
+	})
+
+	t.Run("MissingName", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{{Content: "exit 0", Timeout: Duration(time.Second)}}})
+
+		if err == nil || !strings.Contains(err.Error(), "script 0: `name` required") {
+			t.Errorf("Expected missing name to be reported, received %v", err)
+		}
+	})
+
+	t.Run("DuplicateName", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{
+			{Name: "dup", Content: "exit 0", Timeout: Duration(time.Second)},
+			{Name: "dup", Content: "exit 1", Timeout: Duration(time.Second)},
+		}})
+
+		if err == nil || !strings.Contains(err.Error(), `script "dup": duplicate name`) {
+			t.Errorf("Expected duplicate name to be reported, received %v", err)
+		}
+	})
+
+	t.Run("MissingContent", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{{Name: "empty", Timeout: Duration(time.Second)}}})
+
+		if err == nil || !strings.Contains(err.Error(), `script "empty": `+"`script` or `command` required") {
+			t.Errorf("Expected missing script to be reported, received %v", err)
+		}
+	})
+
+	t.Run("ScriptAndCommand", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{{Name: "both", Content: "exit 0", Command: "true", Timeout: Duration(time.Second)}}})
+
+		if err == nil || !strings.Contains(err.Error(), `script "both": `+"`script` and `command` are mutually exclusive") {
+			t.Errorf("Expected script and command to be reported, received %v", err)
+		}
+	})
+
+	t.Run("MissingDir", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "missing")
+		err := validateConfig(&Config{Scripts: []*Script{{Name: "nodir", Content: "exit 0", Timeout: Duration(time.Second), Dir: missing}}})
+
+		if err == nil || !strings.Contains(err.Error(), `script "nodir": `+"`dir`") {
+			t.Errorf("Expected missing dir to be reported, received %v", err)
+		}
+	})
+
+	t.Run("InvalidLabel", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{
+			{Name: "labels", Content: "exit 0", Timeout: Duration(time.Second), Labels: map[string]string{"script": "x", "not-valid": "y"}},
+		}})
+
+		if err == nil || strings.Count(err.Error(), "invalid label name") != 2 {
+			t.Errorf("Expected invalid labels to be reported, received %v", err)
+		}
+	})
+
+	t.Run("StdinWithoutCommand", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{
+			{Name: "stdin", Content: "cat", Stdin: "data", Timeout: Duration(time.Second)},
+		}})
+
+		if err == nil || !strings.Contains(err.Error(), "`stdin` requires `command`") {
+			t.Errorf("Expected stdin without command to be rejected, received %v", err)
+		}
+	})
+
+	t.Run("NegativeTimeout", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{{Name: "negative", Content: "exit 0", Timeout: -1}}})
+
+		if err == nil || !strings.Contains(err.Error(), `script "negative": `+"`timeout` must be positive") {
+			t.Errorf("Expected negative timeout to be reported, received %v", err)
+		}
+	})
+
+	t.Run("AllProblems", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{
+			{Name: "dup", Content: "exit 0", Timeout: -1},
+			{Name: "dup", Timeout: Duration(time.Second)},
+		}})
+
+		if err == nil || strings.Count(err.Error(), ";") != 2 {
+			t.Errorf("Expected three problems to be reported, received %v", err)
+		}
+	})
+}
+
+func TestReloadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+
+	writeFile(t, configFile, `
+scripts:
+  - name: first
+    script: exit 0
+`)
+
+	sc := &SafeConfig{}
+
+	if err := sc.ReloadConfig(configFile); err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if len(sc.Get().Scripts) != 1 {
+		t.Fatalf("Expected 1 script, received %d", len(sc.Get().Scripts))
+	}
+
+	if scripts := testutil.ToFloat64(configuredScripts); scripts != 1 {
+		t.Errorf("Expected script_exporter_scripts_total 1, received %f", scripts)
+	}
+
+	if success := testutil.ToFloat64(configReloadSuccess); success != 1 {
+		t.Errorf("Expected script_exporter_config_last_reload_success 1, received %f", success)
+	}
+
+	reloadedAt := testutil.ToFloat64(configReloadSeconds)
+
+	if reloadedAt == 0 {
+		t.Errorf("Expected script_exporter_config_last_reload_timestamp_seconds to be set")
+	}
+
+	writeFile(t, configFile, `
+scripts:
+  - name: first
+    script: exit 0
+  - name: second
+    script: exit 1
+    timeout: 3
+`)
+
+	if err := sc.ReloadConfig(configFile); err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	scripts := sc.Get().Scripts
+
+	if len(scripts) != 2 || scripts[1].Name != "second" {
+		t.Fatalf("Expected reloaded config to contain new script")
+	}
+
+	if total := testutil.ToFloat64(configuredScripts); total != 2 {
+		t.Errorf("Expected script_exporter_scripts_total 2, received %f", total)
+	}
+
+	if scripts[0].Timeout != Duration(15*time.Second) || scripts[1].Timeout != Duration(3*time.Second) {
+		t.Errorf("Expected timeouts 15s and 3s, received %s and %s", time.Duration(scripts[0].Timeout), time.Duration(scripts[1].Timeout))
+	}
+
+	writeFile(t, configFile, "scripts: [")
+
+	if err := sc.ReloadConfig(configFile); err == nil {
+		t.Errorf("Expected failure when reloading invalid config")
+	}
+
+	if len(sc.Get().Scripts) != 2 || testutil.ToFloat64(configuredScripts) != 2 {
+		t.Errorf("Expected previous config to be kept after failed reload")
+	}
+
+	if success := testutil.ToFloat64(configReloadSuccess); success != 0 {
+		t.Errorf("Expected script_exporter_config_last_reload_success 0, received %f", success)
+	}
+
+	if testutil.ToFloat64(configReloadSeconds) < reloadedAt {
+		t.Errorf("Expected failed reload to update script_exporter_config_last_reload_timestamp_seconds")
+	}
+}
+
+// writeFile writes content to path, failing the test if it can't.
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %s", path, err)
+	}
+}
+
+// writeCertificate creates a certificate for 127.0.0.1 signed by parent, or
+// self-signed when parent is nil, and writes it and its key to dir as
+// name.crt and name.key.
+func writeCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatalf("Unable to write certificate: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatalf("Unable to write key: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatalf("Unable to parse certificate: %s", err)
+	}
+
+	return cert, key
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, _ := writeCertificate(t, dir, "server", nil, nil)
+	webConfigFile := filepath.Join(dir, "web.yml")
+
+	writeFile(t, webConfigFile, "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	defer server.Close()
+
+	go serve(server, listener, webConfigFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	resp.Body.Close()
+
+	if resp.TLS == nil {
+		t.Errorf("Expected response to be served over TLS")
+	}
+}
+
+func TestServeTLSClientCA(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, _ := writeCertificate(t, dir, "server", nil, nil)
+	ca, caKey := writeCertificate(t, dir, "ca", nil, nil)
+	writeCertificate(t, dir, "client", ca, caKey)
+	writeCertificate(t, dir, "rogue", nil, nil)
+	webConfigFile := filepath.Join(dir, "web.yml")
+
+	writeFile(t, webConfigFile, "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_ca_file: ca.crt\n")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+		ErrorLog: stdlog.New(ioutil.Discard, "", 0),
+	}
+	defer server.Close()
+
+	go serve(server, listener, webConfigFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCert)
+
+	get := func(clientCert string) error {
+		tlsConfig := &tls.Config{RootCAs: pool}
+
+		if clientCert != "" {
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, clientCert+".crt"), filepath.Join(dir, clientCert+".key"))
+
+			if err != nil {
+				t.Fatalf("Unable to load client certificate: %s", err)
+			}
+
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get("https://" + listener.Addr().String())
+
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		return err
+	}
+
+	if err := get("client"); err != nil {
+		t.Errorf("Expected client with a certificate signed by the CA to connect: %s", err)
+	}
+
+	if err := get("rogue"); err == nil {
+		t.Errorf("Expected client with an unknown certificate to be rejected")
+	}
+
+	if err := get(""); err == nil {
+		t.Errorf("Expected client without a certificate to be rejected")
+	}
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	webConfigFile := filepath.Join(t.TempDir(), "web.yml")
+
+	writeFile(t, webConfigFile, "tls_server_config:\n  cert_file: server.crt\n")
+
+	if _, err := loadWebConfig(webConfigFile); err == nil {
+		t.Errorf("Expected failure when key_file is missing")
+	}
+}
+
+func TestBasicAuthHandler(t *testing.T) {
+	handler := basicAuthHandler("user", "secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	t.Run("Authorized", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.SetBasicAuth("user", "secret")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+			t.Errorf("Expected authorized request to succeed, received %d", rec.Code)
+		}
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		for _, setAuth := range []func(*http.Request){
+			func(r *http.Request) {},
+			func(r *http.Request) { r.SetBasicAuth("user", "wrong") },
+		} {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			setAuth(req)
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d, received %d", http.StatusUnauthorized, rec.Code)
+			}
+
+			if rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected WWW-Authenticate header")
+			}
+		}
+	})
+}
+
+func TestPrometheusFormat(t *testing.T) {
+	promConfig := &Config{
+		Scripts: []*Script{
+			{Name: "disk_a", Content: `printf '# TYPE disk_free_bytes gauge\ndisk_free_bytes{device="a"} 1.5\n'`, Timeout: Duration(time.Second), Format: "prometheus"},
+			{Name: "disk_b", Content: `printf '# TYPE disk_free_bytes gauge\ndisk_free_bytes{device="b"} 2.5\n'`, Timeout: Duration(time.Second), Format: "prometheus"},
+			{Name: "ignored", Content: `echo 'not_parsed 1'`, Timeout: Duration(time.Second)},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/probe?pattern=.*", nil)
+	rec := httptest.NewRecorder()
+
+	scriptRunHandler(rec, req, promConfig)
+
+	body := rec.Body.String()
+
+	for _, expected := range []string{
+		`disk_free_bytes{device="a",script="disk_a"} 1.5`,
+		`disk_free_bytes{device="b",script="disk_b"} 2.5`,
+		`script_success{script="ignored"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in output: %s", expected, body)
+		}
+	}
+
+	if strings.Count(body, "# TYPE disk_free_bytes") != 1 {
+		t.Errorf("Expected metric family to be merged: %s", body)
+	}
+
+	if strings.Contains(body, "not_parsed") {
+		t.Errorf("Expected output of script without format to be ignored: %s", body)
+	}
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	*metricsPrefix = "teamA_"
+	defer func() { *metricsPrefix = "" }()
+
+	script := &Script{
+		Name:    "queues",
+		Content: `echo 'queue_length 3'`,
+		Timeout: Duration(time.Second),
+		Format:  "prometheus",
+	}
+
+	rec := httptest.NewRecorder()
+	scriptRunHandler(rec, httptest.NewRequest("GET", "/probe?name=queues", nil), &Config{Scripts: []*Script{script}})
+
+	body := rec.Body.String()
+
+	if !strings.Contains(body, `teamA_queue_length{script="queues"} 3`) || strings.Contains(body, "\nqueue_length") {
+		t.Errorf("Expected parsed metrics to be prefixed: %s", body)
+	}
+
+	if !strings.Contains(body, `script_success{script="queues"} 1`) {
+		t.Errorf("Expected probe metrics not to be prefixed: %s", body)
+	}
+}
+
+func TestScriptNamePlaceholder(t *testing.T) {
+	content := `echo 'backup_ok{job="nightly-$SCRIPT_NAME",script="shared"} 1'`
+	placeholderConfig := &Config{
+		Scripts: []*Script{
+			{Name: "backup_db", Content: content, Timeout: Duration(time.Second), Format: "prometheus"},
+			{Name: "backup_files", Content: content, Timeout: Duration(time.Second), Format: "prometheus"},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	scriptRunHandler(rec, httptest.NewRequest("GET", "/probe?pattern=backup_.*", nil), placeholderConfig)
+
+	for _, expected := range []string{
+		`backup_ok{job="nightly-backup_db",script="shared"} 1`,
+		`backup_ok{job="nightly-backup_files",script="shared"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("Expected %q in output: %s", expected, rec.Body.String())
+		}
+	}
+}
+
+func TestPrometheusFormatTimestamps(t *testing.T) {
+	script := &Script{
+		Name:    "backfill",
+		Content: `echo 'batch_records_total 42 1700000000000'`,
+		Timeout: Duration(time.Second),
+		Format:  "prometheus",
+	}
+
+	rec := httptest.NewRecorder()
+	scriptRunHandler(rec, httptest.NewRequest("GET", "/probe?name=backfill", nil), &Config{Scripts: []*Script{script}})
+
+	if expected := `batch_records_total{script="backfill"} 42 1700000000000`; !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("Expected %q in output: %s", expected, rec.Body.String())
+	}
+}
+
+func TestRunScriptMaxOutputBytes(t *testing.T) {
+	// Prints a metric line followed by far more output than the limit.
+	script := &Script{
+		Name:           "chatty",
+		Content:        `echo 'first_metric 1'; echo 'second_metric 2'; yes | head -c 1000000`,
+		Timeout:        Duration(5 * time.Second),
+		Format:         "prometheus",
+		MaxOutputBytes: 32,
+	}
+
+	var output []byte
+	var err error
+
+	logs := captureLogs(t, func() {
+		output, err = runScript(context.Background(), script)
+	})
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if string(output) != "first_metric 1\nsecond_metric 2\n" {
+		t.Errorf("Expected output truncated to its last complete line, received %q", output)
+	}
+
+	if !strings.Contains(logs, "Output truncated to 32 bytes") {
+		t.Errorf("Expected truncation to be logged: %s", logs)
+	}
+
+	if _, err := parseOutput(script, output); err != nil {
+		t.Errorf("Expected truncated output to parse: %s", err)
+	}
+}
+
+func TestRunScriptStderr(t *testing.T) {
+	script := &Script{
+		Name:    "stderr",
+		Content: `echo 'warning: disk_free_bytes 3' >&2; echo 'disk_free_bytes 1'`,
+		Timeout: Duration(time.Second),
+		Format:  "prometheus",
+	}
+
+	stderrBefore := testutil.ToFloat64(scriptStderrBytes.WithLabelValues(script.Name))
+
+	output, err := runScript(context.Background(), script)
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	families, err := parseOutput(script, output)
+
+	if err != nil {
+		t.Fatalf("Expected stderr to be kept out of parsed output: %s", err.Error())
+	}
+
+	if len(families) != 1 || families["disk_free_bytes"].Metric[0].GetUntyped().GetValue() != 1 {
+		t.Errorf("Expected only the metric written to stdout, received %v", families)
+	}
+
+	stderrBytes := testutil.ToFloat64(scriptStderrBytes.WithLabelValues(script.Name)) - stderrBefore
+
+	if stderrBytes != float64(len("warning: disk_free_bytes 3\n")) {
+		t.Errorf("Expected stderr bytes to be counted, received %f", stderrBytes)
+	}
+}
+
+func TestScriptParseErrors(t *testing.T) {
+	scripts := []*Script{
+		{Name: "garbage_prometheus", Content: "echo 'this is not { a metric'", Timeout: Duration(time.Second), Format: "prometheus"},
+		{Name: "garbage_json", Content: "echo 'not json'", Timeout: Duration(time.Second), Format: "json"},
+		{Name: "valid_json", Content: `echo '{"name": "a", "value": 1}'`, Timeout: Duration(time.Second), Format: "json"},
+		{Name: "reserved_name", Content: "echo 'script_success 5'", Timeout: Duration(time.Second), Format: "prometheus"},
+	}
+
+	before := map[string]float64{}
+
+	for _, script := range scripts {
+		before[script.Name] = testutil.ToFloat64(scriptParseErrors.WithLabelValues(script.Name))
+	}
+
+	runScripts(context.Background(), scripts)
+
+	expectedIncrease := map[string]float64{
+		"garbage_prometheus": 1,
+		"garbage_json":       1,
+		"valid_json":         0,
+		"reserved_name":      1,
+	}
+
+	for name, increase := range expectedIncrease {
+		after := testutil.ToFloat64(scriptParseErrors.WithLabelValues(name))
+
+		if after-before[name] != increase {
+			t.Errorf("Expected parse errors for %s to increase by %f, increased by %f", name, increase, after-before[name])
+		}
+	}
+}
+
+func TestReservedMetricNames(t *testing.T) {
+	script := &Script{Name: "reserved", Content: "echo 'script_success 5'; echo 'queue_length 3'", Timeout: Duration(time.Second), Format: "prometheus"}
+
+	rec := httptest.NewRecorder()
+	scriptRunHandler(rec, httptest.NewRequest("GET", "/probe?name=reserved", nil), &Config{Scripts: []*Script{script}})
+
+	body := rec.Body.String()
+
+	if strings.Count(body, "script_success") != 1 || strings.Contains(body, "# TYPE script_success") {
+		t.Errorf("Expected output reusing a probe metric name to be rejected: %s", body)
+	}
+
+	var parser expfmt.TextParser
+
+	if _, err := parser.TextToMetricFamilies(strings.NewReader(body)); err != nil {
+		t.Errorf("Expected a valid probe response: %s", err)
+	}
+
+	*metricsPrefix = "script_"
+	defer func() { *metricsPrefix = "" }()
+
+	if _, err := parseOutput(&Script{Format: "keyvalue"}, []byte("success 1\n")); err == nil {
+		t.Errorf("Expected a prefixed name colliding with a probe metric to be rejected")
+	}
+}
+
+func TestLastSuccessfulParse(t *testing.T) {
+	script := &Script{Name: "parse_staleness", Content: "echo 'queue_length 3'", Timeout: Duration(time.Second), Format: "prometheus"}
+
+	runScripts(context.Background(), []*Script{script})
+
+	parsedAt := testutil.ToFloat64(lastParseSeconds.WithLabelValues(script.Name))
+
+	if parsedAt == 0 {
+		t.Fatalf("Expected script_last_successful_parse_timestamp_seconds to be set")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	for _, content := range []string{"echo 'this is not a metric'", "exit 0"} {
+		script.Content = content
+		runScripts(context.Background(), []*Script{script})
+
+		if after := testutil.ToFloat64(lastParseSeconds.WithLabelValues(script.Name)); after != parsedAt {
+			t.Errorf("Expected timestamp not to advance for %q, moved from %f to %f", content, parsedAt, after)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		var out bytes.Buffer
+
+		dryRunConfig := &Config{Scripts: []*Script{
+			{Name: "metrics", Content: "echo 'queue_length 3'", Timeout: Duration(time.Second), Format: "prometheus"},
+			{Name: "success", Content: "exit 0", Timeout: Duration(time.Second)},
+		}}
+
+		if !dryRun(context.Background(), &out, dryRunConfig) {
+			t.Errorf("Expected dry run to succeed: %s", out.String())
+		}
+
+		for _, expected := range []string{
+			`script_success{script="metrics"} 1`,
+			`script_success{script="success"} 1`,
+			`queue_length{script="metrics"} 3`,
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("Expected %q in output: %s", expected, out.String())
+			}
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		var out bytes.Buffer
+
+		dryRunConfig := &Config{Scripts: []*Script{
+			{Name: "garbage", Content: "echo 'not json'", Timeout: Duration(time.Second), Format: "json"},
+		}}
+
+		if dryRun(context.Background(), &out, dryRunConfig) {
+			t.Errorf("Expected dry run to fail")
+		}
+
+		if !strings.Contains(out.String(), "# garbage: error parsing output:") {
+			t.Errorf("Expected parse error in output: %s", out.String())
+		}
+	})
+}
+
+func TestScriptLabels(t *testing.T) {
+	labelConfig := &Config{
+		Scripts: []*Script{
+			{
+				Name:    "disk",
+				Content: `echo 'disk_free_bytes{device="sda"} 1'; echo 'disk_free_bytes{device="sdb",source="override"} 2'`,
+				Timeout: Duration(time.Second),
+				Format:  "prometheus",
+				Labels:  map[string]string{"source": "nodeA"},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/probe?name=disk", nil)
+	rec := httptest.NewRecorder()
+
+	scriptRunHandler(rec, req, labelConfig)
+
+	for _, expected := range []string{
+		`script_success{script="disk",source="nodeA"} 1`,
+		`disk_free_bytes{device="sda",script="disk",source="nodeA"} 1`,
+		`disk_free_bytes{device="sdb",script="disk",source="override"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("Expected %q in output: %s", expected, rec.Body.String())
+		}
+	}
+}
+
+func TestExternalLabels(t *testing.T) {
+	os.Setenv("SCRIPT_EXPORTER_TEST_DC", "eu1")
+	defer os.Unsetenv("SCRIPT_EXPORTER_TEST_DC")
+
+	labels, err := parseExternalLabels("hostname=node1,dc=${SCRIPT_EXPORTER_TEST_DC},source=default")
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	externalLabels = labels
+	defer func() { externalLabels = nil }()
+
+	script := &Script{
+		Name:    "disk",
+		Content: `echo 'disk_free_bytes 1'`,
+		Timeout: Duration(time.Second),
+		Format:  "prometheus",
+		Labels:  map[string]string{"source": "nodeA"},
+	}
+
+	rec := httptest.NewRecorder()
+	scriptRunHandler(rec, httptest.NewRequest("GET", "/probe?name=disk", nil), &Config{Scripts: []*Script{script}})
+
+	for _, expected := range []string{
+		`script_success{dc="eu1",hostname="node1",script="disk",source="nodeA"} 1`,
+		`disk_free_bytes{dc="eu1",hostname="node1",script="disk",source="nodeA"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("Expected %q in output: %s", expected, rec.Body.String())
+		}
+	}
+
+	for _, spec := range []string{"hostname", "script=x", "not-valid=x"} {
+		if _, err := parseExternalLabels(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestParseJSONOutput(t *testing.T) {
+	t.Run("Array", func(t *testing.T) {
+		output := []byte(`[
+			{"name": "queue_length", "labels": {"queue": "mail", "host": "a"}, "value": 3},
+			{"name": "queue_length", "labels": {"host": "b", "queue": "mail"}, "value": 1.5}
+		]`)
+
+		families, err := parseJSONOutput(output)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		family, ok := families["queue_length"]
+
+		if !ok || len(family.Metric) != 2 {
+			t.Fatalf("Expected two queue_length samples, received %v", families)
+		}
+
+		metric := family.Metric[1]
+
+		if metric.GetUntyped().GetValue() != 1.5 {
+			t.Errorf("Expected value 1.5, received %f", metric.GetUntyped().GetValue())
+		}
+
+		if metric.Label[0].GetName() != "host" || metric.Label[0].GetValue() != "b" ||
+			metric.Label[1].GetName() != "queue" || metric.Label[1].GetValue() != "mail" {
+			t.Errorf("Expected labels sorted by name, received %v", metric.Label)
+		}
+	})
+
+	t.Run("Objects", func(t *testing.T) {
+		output := []byte(`{"name": "a", "value": 1}
+{"name": "b", "value": 2}`)
+
+		families, err := parseJSONOutput(output)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if len(families) != 2 || families["b"].Metric[0].GetUntyped().GetValue() != 2 {
+			t.Errorf("Expected two metric families, received %v", families)
+		}
+	})
+
+	t.Run("InvalidName", func(t *testing.T) {
+		if _, err := parseJSONOutput([]byte(`{"name": "not-valid", "value": 1}`)); err == nil {
+			t.Errorf("Expected failure for invalid metric name")
+		}
+	})
+}
+
+func TestParseKeyValueOutput(t *testing.T) {
+	t.Run("Labels", func(t *testing.T) {
+		output := []byte("# comment\n\nqueue_length 3 queue=mail host=a\nqueue_length 1.5 host=b queue=mail\nuptime_seconds 12\n")
+
+		families, err := parseKeyValueOutput(output)
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		family, ok := families["queue_length"]
+
+		if !ok || len(family.Metric) != 2 || len(families) != 2 {
+			t.Fatalf("Expected two queue_length samples and uptime_seconds, received %v", families)
+		}
+
+		metric := family.Metric[0]
+
+		if metric.GetUntyped().GetValue() != 3 {
+			t.Errorf("Expected value 3, received %f", metric.GetUntyped().GetValue())
+		}
+
+		if metric.Label[0].GetName() != "host" || metric.Label[0].GetValue() != "a" ||
+			metric.Label[1].GetName() != "queue" || metric.Label[1].GetValue() != "mail" {
+			t.Errorf("Expected labels sorted by name, received %v", metric.Label)
+		}
+	})
+
+	for name, output := range map[string]string{
+		"MissingValue": "queue_length\n",
+		"InvalidValue": "queue_length abc\n",
+		"InvalidLabel": "queue_length 3 queue\n",
+		"InvalidName":  "not-valid 3\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseKeyValueOutput([]byte(output)); err == nil || !strings.HasPrefix(err.Error(), "line 1: ") {
+				t.Errorf("Expected failure on line 1, received %v", err)
+			}
+		})
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	dir := t.TempDir()
+	scriptFile := filepath.Join(dir, "check.sh")
+
+	writeFile(t, scriptFile, "exit 0\n")
+
+	running := &Config{
+		DefaultTimeout: Duration(15 * time.Second),
+		Scripts: []*Script{
+			{Name: "api", Content: "curl -sf $URL", Timeout: Duration(1500 * time.Millisecond), Env: map[string]string{"TOKEN": "secret"}},
+			{Name: "check", Command: "/bin/true", Args: []string{"--fast"}, Timeout: Duration(time.Second)},
+			{Name: "file", ScriptFile: scriptFile, Content: "exit 0\n", Timeout: Duration(time.Second)},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	configHandler(&SafeConfig{C: running}).ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, received %d", http.StatusOK, rec.Code)
+	}
+
+	if strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("Expected environment values to be redacted: %s", rec.Body.String())
+	}
+
+	served := &Config{}
+
+	if err := yaml.Unmarshal(rec.Body.Bytes(), served); err != nil {
+		t.Fatalf("Expected served config to be valid YAML: %s", err)
+	}
+
+	expected := redactConfig(running)
+
+	if served.DefaultTimeout != expected.DefaultTimeout || len(served.Scripts) != len(expected.Scripts) {
+		t.Fatalf("Expected served config to round-trip: %s", rec.Body.String())
+	}
+
+	for i, script := range served.Scripts {
+		want := expected.Scripts[i]
+
+		if script.Name != want.Name || script.Content != want.Content || script.Command != want.Command ||
+			script.Timeout != want.Timeout || fmt.Sprint(script.Args) != fmt.Sprint(want.Args) ||
+			fmt.Sprint(script.Env) != fmt.Sprint(want.Env) {
+			t.Errorf("Expected script %+v, received %+v", want, script)
+		}
+	}
+
+	if running.Scripts[0].Env["TOKEN"] != "secret" || running.Scripts[2].Content != "exit 0\n" {
+		t.Errorf("Expected running config not to be modified")
+	}
+
+	servedFile := filepath.Join(dir, "served.yml")
+
+	writeFile(t, servedFile, rec.Body.String())
+
+	reloaded, err := loadConfig(servedFile)
+
+	if err != nil {
+		t.Fatalf("Expected served config to load: %s", err)
+	}
+
+	if reloaded.Scripts[2].Content != "exit 0\n" {
+		t.Errorf("Expected script_file to be read again, received %q", reloaded.Scripts[2].Content)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	for _, enableGzip := range []bool{true, false} {
+		t.Run(fmt.Sprintf("Gzip=%t", enableGzip), func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			metricsHandler(promhttp.HandlerOpts{DisableCompression: !enableGzip}).ServeHTTP(rec, req)
+
+			body := io.Reader(rec.Body)
+
+			if enableGzip {
+				if rec.Header().Get("Content-Encoding") != "gzip" {
+					t.Fatalf("Expected a gzip-encoded response")
+				}
+
+				gz, err := gzip.NewReader(rec.Body)
+
+				if err != nil {
+					t.Fatalf("Unexpected: %s", err.Error())
+				}
+
+				body = gz
+			} else if rec.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("Expected an uncompressed response")
+			}
+
+			out, err := ioutil.ReadAll(body)
+
+			if err != nil {
+				t.Fatalf("Unexpected: %s", err.Error())
+			}
+
+			if !strings.Contains(string(out), "script_exporter_build_info") {
+				t.Errorf("Expected exporter metrics in response: %s", out)
+			}
+		})
+	}
+}
+
+func TestUnregisterDefaultCollectors(t *testing.T) {
+	gatherNames := func() map[string]bool {
+		families, err := prometheus.DefaultGatherer.Gather()
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		names := make(map[string]bool)
+
+		for _, family := range families {
+			names[family.GetName()] = true
+		}
+
+		return names
+	}
+
+	if !gatherNames()["go_goroutines"] {
+		t.Fatalf("Expected go_goroutines to be registered by default")
+	}
+
+	unregisterDefaultCollectors()
+	defer prometheus.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	names := gatherNames()
+
+	if names["go_goroutines"] || names["process_start_time_seconds"] {
+		t.Errorf("Expected Go and process metrics to be unregistered")
+	}
+
+	if !names["script_exporter_build_info"] {
+		t.Errorf("Expected exporter metrics to remain registered")
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	for _, enableOpenMetrics := range []bool{true, false} {
+		t.Run(fmt.Sprintf("OpenMetrics=%t", enableOpenMetrics), func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+			rec := httptest.NewRecorder()
+
+			metricsHandler(promhttp.HandlerOpts{EnableOpenMetrics: enableOpenMetrics}).ServeHTTP(rec, req)
+
+			isOpenMetrics := strings.HasPrefix(rec.Header().Get("Content-Type"), "application/openmetrics-text") &&
+				strings.HasSuffix(rec.Body.String(), "# EOF\n")
+
+			if isOpenMetrics != enableOpenMetrics {
+				t.Errorf("Expected OpenMetrics %t, received content type %q", enableOpenMetrics, rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestScriptsHandler(t *testing.T) {
+	running := &Config{
+		Scripts: []*Script{
+			{Name: "scripts_ran", Content: "exit 3", Timeout: Duration(time.Second)},
+			{Name: "scripts_never_ran", Content: "exit 0", Timeout: Duration(1500 * time.Millisecond)},
+		},
+	}
+
+	runScripts(context.Background(), running.Scripts[:1])
+
+	rec := httptest.NewRecorder()
+	scriptsHandler(&SafeConfig{C: running}).ServeHTTP(rec, httptest.NewRequest("GET", "/scripts", nil))
+
+	var states []*ScriptState
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &states); err != nil {
+		t.Fatalf("Expected valid JSON: %s", err)
+	}
+
+	if len(states) != 2 || states[0].Name != "scripts_ran" || states[1].Name != "scripts_never_ran" {
+		t.Fatalf("Expected the configured scripts, received %s", rec.Body.String())
+	}
+
+	if run := states[0].LastRun; run == nil || run.Success || run.ExitCode != 3 || run.Time.IsZero() {
+		t.Errorf("Expected the failed run to be reported, received %s", rec.Body.String())
+	}
+
+	if states[1].Timeout != 1.5 || states[1].LastRun != nil {
+		t.Errorf("Expected a script that never ran to have no last run, received %s", rec.Body.String())
+	}
+
+	sc := &SafeConfig{}
+
+	if err := sc.set(&Config{Scripts: running.Scripts[1:]}, nil); err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	lastRunsMu.Lock()
+	_, ok := lastRuns["scripts_ran"]
+	lastRunsMu.Unlock()
+
+	if ok {
+		t.Errorf("Expected the last run of a removed script to be forgotten")
+	}
+}
+
+func TestScriptOutputLines(t *testing.T) {
+	scripts := []*Script{
+		{Name: "lines", Content: "echo one; echo two; printf three", Timeout: Duration(time.Second)},
+		{Name: "no_lines", Content: "exit 0", Timeout: Duration(time.Second)},
+	}
+
+	runScripts(context.Background(), scripts)
+
+	lastRunsMu.Lock()
+	output := lastRuns["lines"].Output
+	lastRunsMu.Unlock()
+
+	if output != nil {
+		t.Errorf("Expected output not to be kept with /output disabled, received %q", output)
+	}
+
+	*enableOutput = true
+	defer func() { *enableOutput = false }()
+
+	runScripts(context.Background(), scripts)
+
+	if lines := testutil.ToFloat64(scriptOutputLines.WithLabelValues("lines")); lines != 3 {
+		t.Errorf("Expected 3 output lines, received %f", lines)
+	}
+
+	if lines := testutil.ToFloat64(scriptOutputLines.WithLabelValues("no_lines")); lines != 0 {
+		t.Errorf("Expected 0 output lines, received %f", lines)
+	}
+
+	rec := httptest.NewRecorder()
+	outputHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/output?name=lines", nil))
+
+	if rec.Body.String() != "one\ntwo\nthree" {
+		t.Errorf("Expected last output to be served, received %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	outputHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/output?name=never_ran", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a script that never ran, received %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	sc := &SafeConfig{}
+
+	health := func() int {
+		rec := httptest.NewRecorder()
+		healthHandler(sc).ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		return rec.Code
+	}
+
+	if code := health(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d before config is loaded, received %d", http.StatusServiceUnavailable, code)
+	}
+
+	writeFile(t, configFile, "scripts:\n  - name: success\n    script: exit 0\n")
+
+	if err := sc.ReloadConfig(configFile); err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if code := health(); code != http.StatusOK {
+		t.Errorf("Expected status %d after config is loaded, received %d", http.StatusOK, code)
+	}
+
+	writeFile(t, configFile, "scripts: [")
+
+	sc.ReloadConfig(configFile)
+
+	if code := health(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d after failed reload, received %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	families, err := prometheus.DefaultGatherer.Gather()
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	for _, family := range families {
+		if family.GetName() != "script_exporter_build_info" {
+			continue
+		}
+
+		metric := family.Metric[0]
+
+		if metric.GetGauge().GetValue() != 1 {
+			t.Errorf("Expected build info value 1, received %f", metric.GetGauge().GetValue())
+		}
+
+		for _, label := range metric.Label {
+			if label.GetName() == "version" && label.GetValue() == version.Version {
+				return
+			}
+		}
+
+		t.Fatalf("Expected version label %q, received %v", version.Version, metric.Label)
+	}
+
+	t.Errorf("Expected script_exporter_build_info to be registered")
+}
+
+func TestSetLogFormat(t *testing.T) {
+	if err := setLogFormat("xml"); err == nil {
+		t.Errorf("Expected failure for unsupported log format")
+	}
+
+	var err error
+
+	output := captureLogs(t, func() {
+		if err = setLogFormat("json"); err == nil {
+			log.With("script", "success").Infof("hello")
+		}
+	})
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	var entry map[string]interface{}
+
+	if err := json.Unmarshal([]byte(output), &entry); err != nil {
+		t.Fatalf("Expected JSON log output: %s", err)
+	}
+
+	if entry["msg"] != "hello" || entry["script"] != "success" {
+		t.Errorf("Unexpected log entry: %v", entry)
+	}
+}
+
+func TestLogScriptName(t *testing.T) {
+	scripts := []*Script{
+		{Name: "log_failure", Content: "exit 1", Timeout: Duration(time.Second)},
+		{Name: "log_garbage", Content: "echo 'not json'", Timeout: Duration(time.Second), Format: "json"},
+	}
+
+	output := captureLogs(t, func() {
+		runScripts(context.Background(), scripts)
+	})
+
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if strings.Contains(line, "exit status 1") && !strings.Contains(line, "log_failure") {
+			t.Errorf("Expected script name in failure log: %s", line)
+		}
+
+		if strings.Contains(line, "error parsing output") && !strings.Contains(line, "log_garbage") {
+			t.Errorf("Expected script name in parse error log: %s", line)
+		}
+	}
+
+	if !strings.Contains(output, "exit status 1") || !strings.Contains(output, "error parsing output") {
+		t.Errorf("Expected failure and parse error to be logged: %s", output)
+	}
+}
+
+// captureLogs returns everything written to the base logger while f runs.
+// f may change the log format; the logger writes to stderr again once
+// captureLogs returns.
+func captureLogs(t *testing.T, f func()) string {
+	reader, writer, err := os.Pipe()
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	defer reader.Close()
+
+	output := make(chan []byte)
+
+	go func() {
+		b, _ := ioutil.ReadAll(reader)
+		output <- b
+	}()
+
+	stderr := os.Stderr
+	os.Stderr = writer
+	log.Base().SetFormat("logger:stderr")
+
+	f()
+
+	os.Stderr = stderr
+	log.Base().SetFormat("logger:stderr")
+	writer.Close()
+
+	return string(<-output)
+}
@@ -0,0 +1,67 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in its own process group so that it can be
+// killed along with any processes it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateProcessGroup asks every process in cmd's process group to exit.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// killProcessGroup kills every process in cmd's process group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// lookupCredential finds the user or uid named by runAs and returns the
+// credential to run scripts with, using the user's primary group.
+func lookupCredential(runAs string) (*syscall.Credential, error) {
+	u, err := user.Lookup(runAs)
+
+	if err != nil {
+		if u, err = user.LookupId(runAs); err != nil {
+			return nil, fmt.Errorf("unknown user %q", runAs)
+		}
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+
+	if err != nil {
+		return nil, fmt.Errorf("user %q: invalid uid %q", runAs, u.Uid)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+
+	if err != nil {
+		return nil, fmt.Errorf("user %q: invalid gid %q", runAs, u.Gid)
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// setCredential makes cmd run as the user named by runAs. It must be called
+// after setProcessGroup.
+func setCredential(cmd *exec.Cmd, runAs string) error {
+	credential, err := lookupCredential(runAs)
+
+	if err != nil {
+		return err
+	}
+
+	cmd.SysProcAttr.Credential = credential
+
+	return nil
+}
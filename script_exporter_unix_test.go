@@ -0,0 +1,170 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunScriptKillsProcessGroup(t *testing.T) {
+	script := &Script{Name: "children", Content: "sleep 30 & echo $!; wait", Timeout: Duration(time.Second)}
+
+	output, err := runScript(context.Background(), script)
+
+	if err != errScriptTimeout {
+		t.Fatalf("Expected timeout, received %v", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+
+	if err != nil {
+		t.Fatalf("Expected child pid in output, received %q", output)
+	}
+
+	// The killed child may briefly linger as a zombie until it is reaped.
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			return
+		}
+
+		if stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); err == nil && strings.Contains(string(stat), ") Z ") {
+			return
+		}
+	}
+
+	syscall.Kill(pid, syscall.SIGKILL)
+	t.Errorf("Expected child process %d to be killed on timeout", pid)
+}
+
+func TestRunScriptBackgroundChild(t *testing.T) {
+	script := &Script{Name: "background", Content: "sleep 3 & echo $!", Timeout: Duration(10 * time.Second)}
+	start := time.Now()
+
+	output, err := runScript(context.Background(), script)
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(output))); err == nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+	} else {
+		t.Errorf("Expected child pid in output, received %q", output)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected script to return without waiting for its background child, ran for %s", elapsed)
+	}
+}
+
+func TestRunScriptKillGrace(t *testing.T) {
+	content := "trap 'echo cleaned up; exit 0' TERM; sleep 5 & wait"
+
+	t.Run("Grace", func(t *testing.T) {
+		script := &Script{Name: "grace", Content: content, Timeout: Duration(500 * time.Millisecond), KillGrace: Duration(time.Second)}
+		start := time.Now()
+
+		output, err := runScript(context.Background(), script)
+
+		if err != errScriptTimeout {
+			t.Fatalf("Expected timeout, received %v", err)
+		}
+
+		if !strings.Contains(string(output), "cleaned up") {
+			t.Errorf("Expected script to handle SIGTERM, received %q", output)
+		}
+
+		if elapsed := time.Since(start); elapsed > 1400*time.Millisecond {
+			t.Errorf("Expected script exiting on SIGTERM not to wait out the grace period, ran for %s", elapsed)
+		}
+	})
+
+	t.Run("NoGrace", func(t *testing.T) {
+		script := &Script{Name: "no_grace", Content: content, Timeout: Duration(500 * time.Millisecond)}
+
+		output, err := runScript(context.Background(), script)
+
+		if err != errScriptTimeout {
+			t.Fatalf("Expected timeout, received %v", err)
+		}
+
+		if strings.Contains(string(output), "cleaned up") {
+			t.Errorf("Expected script to be killed without SIGTERM, received %q", output)
+		}
+	})
+
+	t.Run("IgnoresTerm", func(t *testing.T) {
+		script := &Script{Name: "stubborn", Content: "trap '' TERM; sleep 5", Timeout: Duration(200 * time.Millisecond), KillGrace: Duration(200 * time.Millisecond)}
+		start := time.Now()
+
+		if _, err := runScript(context.Background(), script); err != errScriptTimeout {
+			t.Fatalf("Expected timeout, received %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected script ignoring SIGTERM to be killed after the grace period, ran for %s", elapsed)
+		}
+	})
+}
+
+func TestRunScriptRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Running scripts as another user requires root")
+	}
+
+	nobody, err := user.Lookup("nobody")
+
+	if err != nil {
+		t.Skip("No nobody user to run the script as")
+	}
+
+	script := &Script{Name: "run_as", Content: "id -u", Timeout: Duration(time.Second), RunAs: "nobody"}
+
+	output, err := runScript(context.Background(), script)
+
+	if err != nil {
+		t.Fatalf("Unexpected: %s", err.Error())
+	}
+
+	if uid := strings.TrimSpace(string(output)); uid != nobody.Uid {
+		t.Errorf("Expected script to run as uid %s, ran as %s", nobody.Uid, uid)
+	}
+}
+
+func TestLookupCredential(t *testing.T) {
+	t.Run("Name", func(t *testing.T) {
+		credential, err := lookupCredential("root")
+
+		if err != nil {
+			t.Fatalf("Unexpected: %s", err.Error())
+		}
+
+		if credential.Uid != 0 || credential.Gid != 0 {
+			t.Errorf("Expected root to have uid and gid 0, received %d and %d", credential.Uid, credential.Gid)
+		}
+	})
+
+	t.Run("Uid", func(t *testing.T) {
+		if _, err := lookupCredential("0"); err != nil {
+			t.Errorf("Expected a numeric uid to be accepted: %s", err)
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		err := validateConfig(&Config{Scripts: []*Script{
+			{Name: "unknown", Content: "exit 0", Timeout: Duration(time.Second), RunAs: "no-such-user"},
+		}})
+
+		if err == nil || !strings.Contains(err.Error(), `unknown user "no-such-user"`) {
+			t.Errorf("Expected unknown user to be reported, received %v", err)
+		}
+	})
+}